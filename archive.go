@@ -0,0 +1,181 @@
+// Copyright © 2015-2020 Hilko Bengen <bengen@hilluzination.de>
+// All rights reserved.
+//
+// Use of this source code is governed by the license that can be
+// found in the LICENSE file.
+
+package yara
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// ArchiveFormat selects the container format for ScanArchive.
+type ArchiveFormat int
+
+const (
+	// ArchiveZip is a ZIP archive. Since ZIP archives cannot be read
+	// sequentially, the whole archive is read into memory.
+	ArchiveZip ArchiveFormat = iota
+	// ArchiveGzip is a gzip compressed file. It is treated as an
+	// archive containing a single member.
+	ArchiveGzip
+	// ArchiveTar is an uncompressed tar archive.
+	ArchiveTar
+	// ArchiveTarGzip is a gzip compressed tar archive.
+	ArchiveTarGzip
+)
+
+// MaxArchiveMemberSize limits the decompressed size of every archive
+// member that is scanned by ScanArchive, as a guard against
+// decompression bombs.
+var MaxArchiveMemberSize int64 = 64 << 20
+
+// ErrArchiveMemberTooLarge is returned by ScanArchive if an archive
+// member exceeds MaxArchiveMemberSize.
+var ErrArchiveMemberTooLarge = errors.New("archive member too large")
+
+// MaxArchiveSize limits the size of ZIP archives, which are read into
+// memory by ScanArchive.
+var MaxArchiveSize int64 = 256 << 20
+
+// MaxArchiveTotalSize limits the combined decompressed size of all
+// members that are scanned by ScanArchive.
+var MaxArchiveTotalSize int64 = 256 << 20
+
+// ErrArchiveTooLarge is returned by ScanArchive if a ZIP archive
+// exceeds MaxArchiveSize or if the archive's members together exceed
+// MaxArchiveTotalSize.
+var ErrArchiveTooLarge = errors.New("archive too large")
+
+// ArchiveMatch contains the rules that have matched an archive member.
+type ArchiveMatch struct {
+	Member  string
+	Matches MatchRules
+}
+
+// ScanArchive decompresses the members of an archive read from rd and
+// scans each of them using the ruleset. Only regular files are
+// scanned. For every member that is matched by at least one rule, an
+// ArchiveMatch is returned; the Source field of each MatchRule is set
+// to the member's name. If cb is not nil, it is called for every
+// member, in addition to collecting the matches.
+//
+// Every member is read into memory before it is scanned; if its size
+// exceeds MaxArchiveMemberSize, scanning stops and an error wrapping
+// ErrArchiveMemberTooLarge is returned. Scanning also stops with an
+// error wrapping ErrArchiveTooLarge once the members that have been
+// read exceed MaxArchiveTotalSize in total, or, for ZIP archives, if
+// the archive itself exceeds MaxArchiveSize.
+func (r *Rules) ScanArchive(rd io.Reader, format ArchiveFormat, flags ScanFlags, timeout time.Duration, cb ScanCallback) (matches []ArchiveMatch, err error) {
+	var total int64
+	scan := func(name string, member io.Reader) error {
+		buf, err := readArchiveMember(member)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if total += int64(len(buf)); total > MaxArchiveTotalSize {
+			return fmt.Errorf("%s: %w", name, ErrArchiveTooLarge)
+		}
+		var m MatchRules
+		var sc ScanCallback = m.Collector().SetSource(name)
+		if cb != nil {
+			sc = MultiCallback{sc, cb}
+		}
+		if err := r.ScanMem(buf, flags, timeout, sc); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if len(m) > 0 {
+			matches = append(matches, ArchiveMatch{Member: name, Matches: m})
+		}
+		return nil
+	}
+	switch format {
+	case ArchiveZip:
+		err = scanZip(rd, scan)
+	case ArchiveGzip:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(rd); err != nil {
+			return
+		}
+		err = scan(zr.Name, zr)
+	case ArchiveTar:
+		err = scanTar(rd, scan)
+	case ArchiveTarGzip:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(rd); err != nil {
+			return
+		}
+		err = scanTar(zr, scan)
+	default:
+		err = errors.New("unknown archive format")
+	}
+	return
+}
+
+// readArchiveMember reads rd, up to MaxArchiveMemberSize bytes.
+func readArchiveMember(rd io.Reader) ([]byte, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(rd, MaxArchiveMemberSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > MaxArchiveMemberSize {
+		return nil, ErrArchiveMemberTooLarge
+	}
+	return buf, nil
+}
+
+func scanZip(rd io.Reader, scan func(string, io.Reader) error) error {
+	buf, err := ioutil.ReadAll(io.LimitReader(rd, MaxArchiveSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(buf)) > MaxArchiveSize {
+		return ErrArchiveTooLarge
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		member, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		err = scan(f.Name, member)
+		member.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanTar(rd io.Reader, scan func(string, io.Reader) error) error {
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if err := scan(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright © 2015-2020 Hilko Bengen <bengen@hilluzination.de>
+// All rights reserved.
+//
+// Use of this source code is governed by the license that can be
+// found in the LICENSE file.
+
+package yara
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+)
+
+var archiveMembers = []struct{ name, content string }{
+	{"clean.txt", "nothing to see here"},
+	{"dir/evil.txt", "this contains EVIL data"},
+}
+
+func makeZip(t *testing.T) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, m := range archiveMembers {
+		w, err := zw.Create(m.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(m.content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range archiveMembers {
+		if err := tw.WriteHeader(&tar.Header{
+			Name: m.name, Mode: 0644, Size: int64(len(m.content)), Typeflag: tar.TypeReg,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(m.content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeGzip(t *testing.T, name string, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Name = name
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestScanArchive(t *testing.T) {
+	r := makeRules(t, `rule evil { strings: $a = "EVIL" condition: $a }`)
+	for _, tc := range []struct {
+		format   ArchiveFormat
+		data     []byte
+		expected string
+	}{
+		{ArchiveZip, makeZip(t), "dir/evil.txt"},
+		{ArchiveTar, makeTar(t), "dir/evil.txt"},
+		{ArchiveTarGzip, makeGzip(t, "", makeTar(t)), "dir/evil.txt"},
+		{ArchiveGzip, makeGzip(t, "evil.txt", []byte("EVIL")), "evil.txt"},
+	} {
+		matches, err := r.ScanArchive(bytes.NewReader(tc.data), tc.format, 0, 0, nil)
+		if err != nil {
+			t.Errorf("format %d: %v", tc.format, err)
+			continue
+		}
+		if len(matches) != 1 || matches[0].Member != tc.expected ||
+			len(matches[0].Matches) != 1 || matches[0].Matches[0].Rule != "evil" ||
+			matches[0].Matches[0].Source != tc.expected {
+			t.Errorf("format %d: unexpected matches %+v", tc.format, matches)
+		}
+	}
+}
+
+func TestScanArchiveMemberTooLarge(t *testing.T) {
+	r := makeRules(t, `rule evil { strings: $a = "EVIL" condition: $a }`)
+	defer func(n int64) { MaxArchiveMemberSize = n }(MaxArchiveMemberSize)
+	MaxArchiveMemberSize = 16
+	_, err := r.ScanArchive(bytes.NewReader(makeZip(t)), ArchiveZip, 0, 0, nil)
+	if !errors.Is(err, ErrArchiveMemberTooLarge) {
+		t.Errorf("expected ErrArchiveMemberTooLarge, got %v", err)
+	}
+}
+
+func TestScanArchiveTooLarge(t *testing.T) {
+	r := makeRules(t, `rule evil { strings: $a = "EVIL" condition: $a }`)
+	defer func(n int64) { MaxArchiveSize = n }(MaxArchiveSize)
+	MaxArchiveSize = 16
+	_, err := r.ScanArchive(bytes.NewReader(makeZip(t)), ArchiveZip, 0, 0, nil)
+	if !errors.Is(err, ErrArchiveTooLarge) {
+		t.Errorf("zip: expected ErrArchiveTooLarge, got %v", err)
+	}
+}
+
+func TestScanArchiveTotalTooLarge(t *testing.T) {
+	r := makeRules(t, `rule evil { strings: $a = "EVIL" condition: $a }`)
+	defer func(n int64) { MaxArchiveTotalSize = n }(MaxArchiveTotalSize)
+	// Both members fit individually, but not together.
+	MaxArchiveTotalSize = int64(len(archiveMembers[0].content) + len(archiveMembers[1].content) - 1)
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		format ArchiveFormat
+	}{
+		{"zip", makeZip(t), ArchiveZip},
+		{"tar", makeTar(t), ArchiveTar},
+		{"tar.gz", makeGzip(t, "", makeTar(t)), ArchiveTarGzip},
+	} {
+		_, err := r.ScanArchive(bytes.NewReader(tc.data), tc.format, 0, 0, nil)
+		if !errors.Is(err, ErrArchiveTooLarge) {
+			t.Errorf("%s: expected ErrArchiveTooLarge, got %v", tc.name, err)
+		}
+	}
+	MaxArchiveTotalSize++
+	if _, err := r.ScanArchive(bytes.NewReader(makeZip(t)), ArchiveZip, 0, 0, nil); err != nil {
+		t.Errorf("members at the limit: %v", err)
+	}
+}
@@ -19,13 +19,24 @@ package yara
 void compilerCallback(int, char*, int, YR_RULE*, char*, void*);
 char* includeCallback(char*, char*, char*, void*);
 void freeCallback(char*, void*);
+
+// compiler_has_rule returns 1 if a rule with the given identifier has
+// been added to the namespace.
+static int compiler_has_rule(YR_COMPILER* compiler, const char* identifier, const char* ns) {
+	return yr_hash_table_lookup_uint32(compiler->rules_table, identifier, ns) != UINT32_MAX;
+}
 */
 import "C"
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
+	"time"
 	"unsafe"
 )
 
@@ -39,6 +50,9 @@ func compilerCallback(errorLevel C.int, filename *C.char, linenumber C.int, rule
 	}
 	switch errorLevel {
 	case C.YARA_ERROR_LEVEL_ERROR:
+		if c.cptr.last_error == C.ERROR_DUPLICATED_IDENTIFIER {
+			msg.Identifier = C.GoString(&c.cptr.last_error_extra_info[0])
+		}
 		c.Errors = append(c.Errors, msg)
 	case C.YARA_ERROR_LEVEL_WARNING:
 		c.Warnings = append(c.Warnings, msg)
@@ -51,12 +65,20 @@ func compilerCallback(errorLevel C.int, filename *C.char, linenumber C.int, rule
 //
 // Since this type contains a C pointer to a YR_COMPILER structure
 // that may be automatically freed, it should not be copied.
+//
+// Separate Compiler instances do not share state and may be used
+// concurrently from different goroutines. A single Compiler must not
+// be used by more than one goroutine at a time.
 type Compiler struct {
 	Errors   []CompilerMessage
 	Warnings []CompilerMessage
 	// used for include callback
 	callbackData unsafe.Pointer
 	cptr         *C.YR_COMPILER
+	// set by SetStrict
+	strict bool
+	// set by SetDefaultNamespace
+	defaultNamespace string
 }
 
 // A CompilerMessage contains an error or warning message produced
@@ -65,6 +87,10 @@ type CompilerMessage struct {
 	Filename string
 	Line     int
 	Text     string
+	// Identifier is set for "duplicated identifier" errors. It
+	// contains the name that has already been declared. (libyara
+	// does not record where the first declaration was.)
+	Identifier string
 }
 
 // NewCompiler creates a YARA compiler.
@@ -82,6 +108,7 @@ func NewCompiler() (*Compiler, error) {
 //
 // It should not be necessary to call this method directly.
 func (c *Compiler) Destroy() {
+	c.setCallbackData(nil)
 	if c.cptr != nil {
 		C.yr_compiler_destroy(c.cptr)
 		c.cptr = nil
@@ -96,17 +123,62 @@ func (c *Compiler) setCallbackData(ptr unsafe.Pointer) {
 	c.callbackData = ptr
 }
 
+// HasRule returns true if a rule with the given identifier has
+// already been added to the namespace. The empty string refers to
+// the default namespace. This can be used to detect duplicate rules
+// before adding them.
+func (c *Compiler) HasRule(namespace, identifier string) bool {
+	if namespace = c.namespace(namespace); namespace == "" {
+		namespace = "default"
+	}
+	cns := C.CString(namespace)
+	defer C.free(unsafe.Pointer(cns))
+	cid := C.CString(identifier)
+	defer C.free(unsafe.Pointer(cid))
+	has := C.compiler_has_rule(c.cptr, cid, cns) != 0
+	runtime.KeepAlive(c)
+	return has
+}
+
+// A CompileError is returned by AddFile and AddString if the rules
+// cannot be compiled. Version is the version of libyara that was used;
+// rules using syntax introduced by later versions of YARA fail with a
+// syntax error.
+type CompileError struct {
+	Message string
+	Code    int
+	Version string
+}
+
+func (e CompileError) Error() string {
+	if e.Code == C.ERROR_SYNTAX_ERROR {
+		return e.Message + " (YARA " + e.Version + ")"
+	}
+	return e.Message
+}
+
+// Unwrap returns the underlying YARA error code as an Error.
+func (e CompileError) Unwrap() error { return Error(e.Code) }
+
+// lastError returns a CompileError for the compiler's last error.
+func (c *Compiler) lastError() error {
+	var buf [1024]C.char
+	msg := C.GoString(C.yr_compiler_get_error_message(
+		c.cptr, (*C.char)(unsafe.Pointer(&buf[0])), 1024))
+	return CompileError{Message: msg, Code: int(c.cptr.last_error), Version: Version()}
+}
+
 // AddFile compiles rules from a file. Rules are added to the
 // specified namespace.
 //
 // If this function returns an error, the Compiler object will become
-// unusable.
+// unusable. Compilation errors are returned as CompileError.
 func (c *Compiler) AddFile(file *os.File, namespace string) (err error) {
 	if c.cptr.errors != 0 {
 		return errors.New("Compiler cannot be used after parse error")
 	}
 	var ns *C.char
-	if namespace != "" {
+	if namespace = c.namespace(namespace); namespace != "" {
 		ns = C.CString(namespace)
 		defer C.free(unsafe.Pointer(ns))
 	}
@@ -117,10 +189,7 @@ func (c *Compiler) AddFile(file *os.File, namespace string) (err error) {
 	C.yr_compiler_set_callback(c.cptr, C.YR_COMPILER_CALLBACK_FUNC(C.compilerCallback), id)
 	numErrors := int(C.yr_compiler_add_fd(c.cptr, (C.YR_FILE_DESCRIPTOR)(file.Fd()), ns, filename))
 	if numErrors > 0 {
-		var buf [1024]C.char
-		msg := C.GoString(C.yr_compiler_get_error_message(
-			c.cptr, (*C.char)(unsafe.Pointer(&buf[0])), 1024))
-		err = errors.New(msg)
+		err = c.lastError()
 	}
 	runtime.KeepAlive(c)
 	return
@@ -130,13 +199,13 @@ func (c *Compiler) AddFile(file *os.File, namespace string) (err error) {
 // specified namespace.
 //
 // If this function returns an error, the Compiler object will become
-// unusable.
+// unusable. Compilation errors are returned as CompileError.
 func (c *Compiler) AddString(rules string, namespace string) (err error) {
 	if c.cptr.errors != 0 {
 		return errors.New("Compiler cannot be used after parse error")
 	}
 	var ns *C.char
-	if namespace != "" {
+	if namespace = c.namespace(namespace); namespace != "" {
 		ns = C.CString(namespace)
 		defer C.free(unsafe.Pointer(ns))
 	}
@@ -147,17 +216,16 @@ func (c *Compiler) AddString(rules string, namespace string) (err error) {
 	C.yr_compiler_set_callback(c.cptr, C.YR_COMPILER_CALLBACK_FUNC(C.compilerCallback), id)
 	numErrors := int(C.yr_compiler_add_string(c.cptr, crules, ns))
 	if numErrors > 0 {
-		var buf [1024]C.char
-		msg := C.GoString(C.yr_compiler_get_error_message(
-			c.cptr, (*C.char)(unsafe.Pointer(&buf[0])), 1024))
-		err = errors.New(msg)
+		err = c.lastError()
 	}
 	runtime.KeepAlive(c)
 	return
 }
 
 // DefineVariable defines a named variable for use by the compiler.
-// Boolean, int64, float64, and string types are supported.
+// Boolean, int64, float64, and string types are supported. A
+// time.Time value is defined as an integer variable containing the
+// number of seconds since the Unix epoch.
 func (c *Compiler) DefineVariable(identifier string, value interface{}) (err error) {
 	cid := C.CString(identifier)
 	defer C.free(unsafe.Pointer(cid))
@@ -170,9 +238,15 @@ func (c *Compiler) DefineVariable(identifier string, value interface{}) (err err
 		err = newError(C.yr_compiler_define_boolean_variable(
 			c.cptr, cid, C.int(v)))
 	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
-		value := toint64(value)
+		var i int64
+		if i, err = toint64(value); err != nil {
+			break
+		}
+		err = newError(C.yr_compiler_define_integer_variable(
+			c.cptr, cid, C.int64_t(i)))
+	case time.Time:
 		err = newError(C.yr_compiler_define_integer_variable(
-			c.cptr, cid, C.int64_t(value)))
+			c.cptr, cid, C.int64_t(value.(time.Time).Unix())))
 	case float64:
 		err = newError(C.yr_compiler_define_float_variable(
 			c.cptr, cid, C.double(value.(float64))))
@@ -182,17 +256,50 @@ func (c *Compiler) DefineVariable(identifier string, value interface{}) (err err
 		err = newError(C.yr_compiler_define_string_variable(
 			c.cptr, cid, cvalue))
 	default:
-		err = errors.New("wrong value type passed to DefineVariable; bool, int64, float64, string are accepted")
+		err = errors.New("wrong value type passed to DefineVariable; bool, int64, float64, string, time.Time are accepted")
 	}
 	runtime.KeepAlive(c)
 	return
 }
 
+// SetStrict enables or disables strict mode. In strict mode,
+// GetRules returns an error if any warnings have been recorded by the
+// compiler.
+func (c *Compiler) SetStrict(strict bool) {
+	c.strict = strict
+}
+
+// SetDefaultNamespace sets the namespace that is used by AddFile and
+// AddString if no namespace is passed. If it is not set, libyara uses
+// "default".
+func (c *Compiler) SetDefaultNamespace(namespace string) {
+	c.defaultNamespace = namespace
+}
+
+// namespace returns the namespace to be used for rules added to
+// namespace.
+func (c *Compiler) namespace(namespace string) string {
+	if namespace == "" {
+		return c.defaultNamespace
+	}
+	return namespace
+}
+
 // GetRules returns the compiled ruleset.
+//
+// If strict mode has been enabled using SetStrict and warnings have
+// been recorded, an error listing all warnings is returned.
 func (c *Compiler) GetRules() (*Rules, error) {
 	if c.cptr.errors != 0 {
 		return nil, errors.New("Compiler cannot be used after parse error")
 	}
+	if c.strict && len(c.Warnings) > 0 {
+		msgs := make([]string, len(c.Warnings))
+		for i, w := range c.Warnings {
+			msgs[i] = fmt.Sprintf("%s:%d: %s", w.Filename, w.Line, w.Text)
+		}
+		return nil, errors.New("Compiler recorded warnings in strict mode: " + strings.Join(msgs, "; "))
+	}
 	var yrRules *C.YR_RULES
 	if err := newError(C.yr_compiler_get_rules(c.cptr, &yrRules)); err != nil {
 		return nil, err
@@ -237,10 +344,50 @@ func freeCallback(callbackResultPtr *C.char, userData unsafe.Pointer) {
 // contents of the included file. It must return a nil return value on
 // error.
 //
+// For rules that have been added using AddString, filename is empty;
+// for rules from included files, it contains the include name that
+// has been passed to the function.
+//
 // See also: yr_compiler_set_include_callback in the YARA C API
 // documentation.
 type CompilerIncludeFunc func(name, filename, namespace string) []byte
 
+// IncludeFromDir returns a CompilerIncludeFunc that reads included
+// files from the file system. Relative include names are resolved
+// relative to the directory of the including file; if that file's
+// name is relative or empty (as is the case for rules added using
+// AddString), it is interpreted relative to dir.
+//
+// For included files, libyara passes the include name as filename, so
+// the function records the path that every include name has been
+// resolved to. If the same relative include name is used for
+// different files, nested includes are resolved relative to the file
+// that has been included most recently under that name. The function
+// must not be shared by compilers that are used concurrently.
+func IncludeFromDir(dir string) CompilerIncludeFunc {
+	resolved := make(map[string]string)
+	return func(name, filename, _ string) []byte {
+		path := name
+		if !filepath.IsAbs(name) {
+			base := dir
+			if p, ok := resolved[filename]; ok {
+				base = filepath.Dir(p)
+			} else if filepath.IsAbs(filename) {
+				base = filepath.Dir(filename)
+			} else if filename != "" {
+				base = filepath.Join(dir, filepath.Dir(filename))
+			}
+			path = filepath.Join(base, name)
+		}
+		resolved[name] = path
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		return buf
+	}
+}
+
 // SetIncludeCallback registers an include function that is called
 // (through Go glue code) by the YARA compiler for every include
 // statement.
@@ -278,8 +425,10 @@ func Compile(rules string, variables map[string]interface{}) (r *Rules, err erro
 		return
 	}
 	defer c.Destroy()
-	for k, v := range variables {
-		if err = c.DefineVariable(k, v); err != nil {
+	// Variables are defined in a fixed order so that the compiled
+	// ruleset does not depend on map iteration order.
+	for _, k := range sortedKeys(variables) {
+		if err = c.DefineVariable(k, variables[k]); err != nil {
 			return
 		}
 	}
@@ -290,6 +439,51 @@ func Compile(rules string, variables map[string]interface{}) (r *Rules, err erro
 	return
 }
 
+// CompileWithTimeout compiles rules like Compile, but gives up after
+// d has elapsed and returns ErrCompileTimeout. It is meant for rules
+// from untrusted sources. The errors recorded by the compiler are
+// returned along with the error.
+//
+// libyara cannot interrupt the compiler: on timeout, compilation
+// continues in the background, and the compiler and any resulting
+// rules are destroyed once it has finished. Abandoned compilations
+// keep using CPU time and memory until then.
+func CompileWithTimeout(rules string, d time.Duration) (*Rules, []CompilerMessage, error) {
+	type result struct {
+		r    *Rules
+		errs []CompilerMessage
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		c, err := NewCompiler()
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer c.Destroy()
+		if res.err = c.AddString(rules, ""); res.err == nil {
+			res.r, res.err = c.GetRules()
+		}
+		res.errs = c.Errors
+		done <- res
+	}()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.r, res.errs, res.err
+	case <-timer.C:
+		go func() {
+			if res := <-done; res.r != nil {
+				res.r.Destroy()
+			}
+		}()
+		return nil, nil, ErrCompileTimeout
+	}
+}
+
 // MustCompile is like Compile but panics if the rules and optional
 // variables can't be compiled. Like regexp.MustCompile, it allows for
 // simple, safe initialization of global or test data.
@@ -300,3 +494,160 @@ func MustCompile(rules string, variables map[string]interface{}) (r *Rules) {
 	}
 	return
 }
+
+// Validate compiles rules using a temporary compiler and returns the
+// warnings recorded by the compiler. If the rules cannot be compiled,
+// an error is returned. The compiled rules are discarded.
+func Validate(rules string) (warnings []CompilerMessage, err error) {
+	var c *Compiler
+	if c, err = NewCompiler(); err != nil {
+		return
+	}
+	defer c.Destroy()
+	err = c.AddString(rules, "")
+	warnings = c.Warnings
+	return
+}
+
+// A SourceError records an error that occurred while compiling rules
+// from a specific source, such as a file.
+type SourceError struct {
+	Source string
+	Err    error
+}
+
+func (e SourceError) Error() string { return e.Source + ": " + e.Err.Error() }
+
+// SourceErrors is returned by functions that compile rules from
+// multiple sources, such as CompileDir, if one or more of the sources
+// could not be compiled.
+type SourceErrors []SourceError
+
+func (e SourceErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, se := range e {
+		msgs[i] = se.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// CompileDir compiles all rule files (*.yar, *.yara) found below the
+// root directory into a single ruleset. Other files are ignored.
+//
+// If namespaceByFile is set, each file's rules are added to a
+// namespace that is named after the file's path relative to root,
+// without extension. Otherwise, all rules are added to the default
+// namespace.
+//
+// If any files cannot be compiled, no ruleset is returned; the
+// returned SourceErrors lists all files that failed. See
+// compileSources for the cost of failing files.
+func CompileDir(root string, namespaceByFile bool) (*Rules, error) {
+	type ruleFile struct{ path, namespace string }
+	var files []ruleFile
+	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := filepath.Ext(path)
+		if !info.Mode().IsRegular() || (ext != ".yar" && ext != ".yara") {
+			return nil
+		}
+		var ns string
+		if namespaceByFile {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			ns = filepath.ToSlash(strings.TrimSuffix(rel, ext))
+		}
+		files = append(files, ruleFile{path, ns})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	addFile := func(c *Compiler, f ruleFile) error {
+		fh, err := os.Open(f.path)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		return c.AddFile(fh, f.namespace)
+	}
+	return compileSources(len(files),
+		func(i int) string { return files[i].path },
+		func(c *Compiler, i int) error { return addFile(c, files[i]) })
+}
+
+// compileSources adds n sources to a new compiler using add and
+// returns the resulting ruleset. Sources that fail are recorded in
+// the returned SourceErrors, using name to identify them, and
+// compilation continues with the remaining sources.
+//
+// A Compiler cannot be used after an error, so after every failure,
+// a new compiler is set up and all sources that have been compiled
+// successfully so far are added again. Compiling n sources of which
+// k fail thus takes up to n*k additional compilations. (Checking
+// every source using a separate compiler first would not work for
+// sources that refer to rules from other sources.)
+func compileSources(n int, name func(i int) string, add func(c *Compiler, i int) error) (*Rules, error) {
+	c, err := NewCompiler()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if c != nil {
+			c.Destroy()
+		}
+	}()
+	var good []int
+	var errs SourceErrors
+	for i := 0; i < n; i++ {
+		err := add(c, i)
+		if err == nil {
+			good = append(good, i)
+			continue
+		}
+		errs = append(errs, SourceError{name(i), err})
+		c.Destroy()
+		if c, err = NewCompiler(); err != nil {
+			return nil, err
+		}
+		for _, g := range good {
+			if err := add(c, g); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return c.GetRules()
+}
+
+// A NamespacedSource is a piece of rule source code that is to be
+// compiled into a specific namespace. Name identifies the source in
+// errors returned by CompileAll.
+type NamespacedSource struct {
+	Name      string
+	Namespace string
+	Source    string
+}
+
+// CompileAll compiles all sources into a single ruleset using a new
+// compiler.
+//
+// Compilation is all-or-nothing: If any sources cannot be compiled,
+// no ruleset is returned; the returned SourceErrors lists all sources
+// that failed. Sources without a Name are identified by their index.
+// See compileSources for the cost of failing sources.
+func CompileAll(sources []NamespacedSource) (*Rules, error) {
+	return compileSources(len(sources),
+		func(i int) string {
+			if sources[i].Name == "" {
+				return fmt.Sprintf("source %d", i)
+			}
+			return sources[i].Name
+		},
+		func(c *Compiler, i int) error { return c.AddString(sources[i].Source, sources[i].Namespace) })
+}
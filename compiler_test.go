@@ -6,7 +6,17 @@
 
 package yara
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestCompiler(t *testing.T) {
 	c, _ := NewCompiler()
@@ -75,3 +85,271 @@ func TestCompilerIncludeCallback(t *testing.T) {
 		t.Fatal(`Compiler did not return error on non-existing include rule`)
 	}
 }
+
+func TestCompilerStrict(t *testing.T) {
+	const rule = `rule slow { strings: $a = { 01 } $b = { 02 } condition: $a or $b }`
+	c, _ := NewCompiler()
+	if err := c.AddString(rule, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Warnings) < 2 {
+		t.Fatalf("expected at least two warnings, got %#v", c.Warnings)
+	}
+	if _, err := c.GetRules(); err != nil {
+		t.Errorf("lenient GetRules: %s", err)
+	}
+
+	c, _ = NewCompiler()
+	c.SetStrict(true)
+	if err := c.AddString(rule, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.GetRules()
+	if err == nil {
+		t.Fatal("strict GetRules did not return error")
+	}
+	for _, w := range c.Warnings {
+		if !strings.Contains(err.Error(), w.Text) {
+			t.Errorf("error %q does not mention warning %q", err, w.Text)
+		}
+	}
+}
+
+func TestCompileDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCompileDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"a.yar":       `rule a { condition: true }`,
+		"sub/b.yara":  `rule b { condition: true }`,
+		"README.txt":  `this is not a rule file`,
+		"sub/c.yarac": `neither is this`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := CompileDir(dir, true)
+	if err != nil {
+		t.Fatalf("CompileDir: %v", err)
+	}
+	expected := map[string]int{"a": 1, "sub/b": 1}
+	if got := r.NamespaceCounts(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected namespaces %v, got %v", expected, got)
+	}
+
+	for _, name := range []string{"bad1.yar", "sub/bad2.yar"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(`rule broken {`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = CompileDir(dir, false)
+	errs, ok := err.(SourceErrors)
+	if !ok {
+		t.Fatalf("expected SourceErrors, got %#v", err)
+	}
+	if len(errs) != 2 {
+		t.Errorf("expected 2 failed files, got %v", errs)
+	}
+	for _, e := range errs {
+		if !strings.Contains(e.Source, "bad") {
+			t.Errorf("unexpected failed file %s", e.Source)
+		}
+	}
+}
+
+func TestCompilerDuplicateRule(t *testing.T) {
+	c, _ := NewCompiler()
+	if err := c.AddString(`rule dup { condition: true }`, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !c.HasRule("", "dup") || !c.HasRule("default", "dup") {
+		t.Error("HasRule did not find rule in default namespace")
+	}
+	if c.HasRule("other", "dup") || c.HasRule("", "nodup") {
+		t.Error("HasRule found nonexistent rule")
+	}
+	if err := c.AddString(`rule dup { condition: false }`, ""); err == nil {
+		t.Fatal("duplicate rule was accepted")
+	}
+	if len(c.Errors) != 1 || c.Errors[0].Identifier != "dup" {
+		t.Errorf("expected error for duplicated identifier dup, got %#v", c.Errors)
+	}
+}
+
+func TestCompilerDefaultNamespace(t *testing.T) {
+	c, _ := NewCompiler()
+	c.SetDefaultNamespace("myfeed")
+	if err := c.AddString(`rule a { condition: true }`, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddString(`rule b { condition: true }`, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.HasRule("", "a") {
+		t.Error("HasRule did not find rule in configured default namespace")
+	}
+	r, err := c.GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m MatchRules
+	if err := r.ScanMem([]byte("dummy"), 0, 0, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m[0].Namespace != "myfeed" || m[1].Namespace != "other" {
+		t.Errorf("unexpected namespaces in matches: %+v", m)
+	}
+}
+
+func TestIncludeFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestIncludeFromDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "rules", "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"common.yar":           `rule common { condition: true }`,
+		"rules/main.yar":       `include "./helper.yar" rule main { condition: helper }`,
+		"rules/helper.yar":     `include "./lib/nested.yar" rule helper { condition: nested }`,
+		"rules/lib/nested.yar": `include "./leaf.yar" rule nested { condition: leaf }`,
+		"rules/lib/leaf.yar":   `rule leaf { condition: true }`,
+		// Decoys that would be picked up if nested includes were
+		// resolved relative to dir.
+		"lib/nested.yar": `rule wrong_nested { condition: true }`,
+		"leaf.yar":       `rule wrong_leaf { condition: true }`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, _ := NewCompiler()
+	c.SetIncludeCallback(IncludeFromDir(dir))
+	if err := c.AddString(`include "common.yar" rule s { condition: common }`, ""); err != nil {
+		t.Fatalf("AddString: %v", err)
+	}
+	f, err := os.Open(filepath.Join(dir, "rules", "main.yar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := c.AddFile(f, "file"); err != nil {
+		t.Fatalf("AddFile: %v", err)
+	}
+	r, err := c.GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{"default": 2, "file": 4}
+	if got := r.NamespaceCounts(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		rules    string
+		warnings bool
+		err      bool
+	}{
+		{`rule ok { condition: true }`, false, false},
+		{`rule slow { strings: $a = { 01 } condition: $a }`, true, false},
+		{`rule broken { condition: }`, false, true},
+	} {
+		warnings, err := Validate(tc.rules)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error value: %v", tc.rules, err)
+		}
+		if (len(warnings) > 0) != tc.warnings {
+			t.Errorf("%s: unexpected warnings: %#v", tc.rules, warnings)
+		}
+	}
+}
+
+func TestCompileAll(t *testing.T) {
+	sources := []NamespacedSource{
+		{Name: "a", Namespace: "ns1", Source: `rule a { condition: true }`},
+		{Name: "b", Namespace: "ns2", Source: `rule b { condition: true }`},
+	}
+	r, err := CompileAll(sources)
+	if err != nil {
+		t.Fatalf("CompileAll: %v", err)
+	}
+	expected := map[string]int{"ns1": 1, "ns2": 1}
+	if got := r.NamespaceCounts(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected namespaces %v, got %v", expected, got)
+	}
+
+	sources = append(sources,
+		NamespacedSource{Name: "broken", Source: `rule broken {`},
+		NamespacedSource{Source: `rule c { condition: true }`},
+		NamespacedSource{Source: `rule d { condition: x }`},
+	)
+	r, err = CompileAll(sources)
+	if r != nil {
+		t.Error("expected no rules")
+	}
+	errs, ok := err.(SourceErrors)
+	if !ok {
+		t.Fatalf("expected SourceErrors, got %#v", err)
+	}
+	if len(errs) != 2 || errs[0].Source != "broken" || errs[1].Source != "source 4" {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
+
+func TestCompileErrorVersion(t *testing.T) {
+	c, err := NewCompiler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	err = c.AddString(`rule t { condition: `, "")
+	var ce CompileError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected CompileError, got %#v", err)
+	}
+	if ce.Version != Version() || !strings.Contains(err.Error(), Version()) {
+		t.Errorf("version %q not reported in %q", Version(), err)
+	}
+	if !errors.Is(err, Error(ce.Code)) {
+		t.Errorf("expected error to wrap code %d", ce.Code)
+	}
+}
+
+func TestCompileWithTimeout(t *testing.T) {
+	r, errs, err := CompileWithTimeout(`rule slow { strings: $a = { 01 } condition: $a }`, 10*time.Second)
+	if err != nil {
+		t.Fatalf("CompileWithTimeout: %v", err)
+	}
+	if len(r.GetRules()) != 1 || len(errs) != 0 {
+		t.Errorf("unexpected result: %d rules, errors %+v", len(r.GetRules()), errs)
+	}
+	r.Destroy()
+
+	if _, errs, err = CompileWithTimeout(`rule broken { condition: }`, 10*time.Second); err == nil || len(errs) != 1 {
+		t.Errorf("expected compiler error, got %v, %+v", err, errs)
+	}
+
+	var b strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&b, "rule r%d { strings: $a = /(a|b|c|d)[a-z]{1,%d}x(y|z)+%d/ condition: $a }\n", i, i%20+1, i)
+	}
+	r, _, err = CompileWithTimeout(b.String(), time.Millisecond)
+	if err == nil {
+		r.Destroy()
+		t.Skip("rules compiled before the timeout")
+	}
+	if err != ErrCompileTimeout {
+		t.Errorf("expected ErrCompileTimeout, got %v", err)
+	}
+}
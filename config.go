@@ -8,8 +8,22 @@ package yara
 
 // #include <yara.h>
 import "C"
-import "unsafe"
+import (
+	"os"
+	"unsafe"
+)
 
+// ConfigName identifies a global YARA configuration option.
+//
+// libyara does not provide an option that limits the memory used by
+// modules while they parse scanned data. The PE and ELF modules
+// validate offsets and sizes against the scanned data and cap the
+// number of parsed entries (e.g. sections and imports) at compile-time
+// constants, rather than allocating memory according to values found
+// in the data. The memory allocated by modules is not visible to Go
+// and cannot be limited through this package. Memory limits for
+// untrusted input should be enforced at the process level, e.g. by
+// scanning in a separate process with resource limits.
 type ConfigName uint32
 
 const (
@@ -39,3 +53,15 @@ func GetConfiguration(name ConfigName) (interface{}, error) {
 	}
 	return int(u), nil
 }
+
+// SetMagicDatabasePath sets the path of the libmagic database that is
+// used by the magic module. libyara loads the default database from
+// within the magic module; the path is passed through the MAGIC
+// environment variable which libmagic consults in that case.
+//
+// Since the magic module loads its database once per operating system
+// thread, SetMagicDatabasePath should be called before any rule using
+// the magic module is evaluated.
+func SetMagicDatabasePath(path string) error {
+	return os.Setenv("MAGIC", path)
+}
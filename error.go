@@ -8,11 +8,53 @@ package yara
 
 // #include <yara.h>
 import "C"
-import "strconv"
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	// ErrBufferTooLarge is returned by the ScanMem methods if the
+	// buffer is larger than what can be passed to libyara.
+	ErrBufferTooLarge = errors.New("buffer too large")
+	// ErrScanTimeout is returned by the Scan* methods if the scan
+	// did not finish within the timeout.
+	ErrScanTimeout error = Error(C.ERROR_SCAN_TIMEOUT)
+	// ErrTooManyMatches is returned by the Scan* methods if a string
+	// has exceeded the maximum number of matches. See
+	// ScanCallbackTooManyMatches.
+	ErrTooManyMatches error = Error(C.ERROR_TOO_MANY_MATCHES)
+	// ErrStackOverflow is returned by the Scan* methods if the
+	// evaluation of a rule condition has exhausted YARA's stack. The
+	// stack size can be raised using ConfigStackSize.
+	ErrStackOverflow error = Error(C.ERROR_EXEC_STACK_OVERFLOW)
+	// ErrRulesReleased is returned by the Scan* methods of Rules and
+	// Scanner if the ruleset has been destroyed.
+	ErrRulesReleased = errors.New("rules have been destroyed")
+	// ErrNilCallback is returned by the Scan* methods of Rules and
+	// Scanner if the callback object is a nil pointer.
+	ErrNilCallback = errors.New("callback is a nil pointer")
+	// ErrScanCanceled is returned by (*Scanner).ScanMemAsync if the
+	// scan has been aborted using the cancel function.
+	ErrScanCanceled = errors.New("scan has been canceled")
+	// ErrCompileTimeout is returned by CompileWithTimeout if the
+	// rules could not be compiled within the timeout.
+	ErrCompileTimeout = errors.New("compilation timed out")
+)
 
 // Error encapsulates the C API error codes.
+//
+// Errors reported by libyara are returned as Error values, so they
+// can be retrieved using errors.As and compared to the error codes
+// from YARA's error.h. Since Error values are comparable, errors.Is
+// works for sentinels such as ErrScanTimeout.
 type Error int
 
+// Code returns the YARA error code.
+func (e Error) Code() int {
+	return int(e)
+}
+
 func (e Error) Error() string {
 	if str, ok := errorStrings[int(e)]; ok {
 		return str
@@ -0,0 +1,130 @@
+// Copyright © 2015-2020 Hilko Bengen <bengen@hilluzination.de>
+// All rights reserved.
+//
+// Use of this source code is governed by the license that can be
+// found in the LICENSE file.
+
+package yara
+
+import (
+	"errors"
+	"time"
+)
+
+// A GrowingScanner scans a stream of data that is appended to
+// incrementally, e.g. captured network traffic. Every call to Scan
+// only scans the data that has been written since the previous call,
+// preceded by a tail of already-scanned data so that strings crossing
+// the boundary are found.
+//
+// The tail's length is the overlap passed to NewGrowingScanner. It
+// must be at least the length of the longest string match that is
+// expected, minus one; matches that are longer than that and cross a
+// boundary are not found. Conditions are evaluated for the scanned
+// window only, so conditions involving filesize, offsets, or the
+// number of string occurrences refer to the window, not the stream.
+//
+// A string match that lies within the tail may be found again by the
+// next scan, possibly with a different length, e.g. for regular
+// expressions that continue beyond the previous end of the data.
+// GrowingScanner suppresses such duplicates: a string match is only
+// reported once for every rule, string, and stream offset.
+type GrowingScanner struct {
+	rules   *Rules
+	overlap int
+	// buf holds the tail of previously scanned data followed by the
+	// data written since. base is the stream offset of buf[0],
+	// scanned the stream offset up to which data has been scanned.
+	buf     []byte
+	base    int64
+	scanned int64
+	// reported contains the string matches that have been reported
+	// at offsets within buf.
+	reported map[streamMatch]bool
+	// Flags and Timeout are used for every scan.
+	Flags   ScanFlags
+	Timeout time.Duration
+}
+
+// streamMatch identifies a string match by rule, string, and stream
+// offset.
+type streamMatch struct {
+	namespace, rule, name string
+	offset                int64
+}
+
+// NewGrowingScanner creates a GrowingScanner that uses rules and keeps
+// overlap bytes of scanned data for the next scan. overlap must not
+// be negative.
+func NewGrowingScanner(rules *Rules, overlap int) (*GrowingScanner, error) {
+	if overlap < 0 {
+		return nil, errors.New("overlap must not be negative")
+	}
+	return &GrowingScanner{rules: rules, overlap: overlap, reported: make(map[streamMatch]bool)}, nil
+}
+
+// Write appends p to the stream. It implements io.Writer and never
+// returns an error.
+func (g *GrowingScanner) Write(p []byte) (int, error) {
+	g.buf = append(g.buf, p...)
+	return len(p), nil
+}
+
+// Offset returns the number of bytes that have been written to the
+// stream.
+func (g *GrowingScanner) Offset() int64 {
+	return g.base + int64(len(g.buf))
+}
+
+// Scan scans the data that has been written since the previous call
+// and returns the rules that have new matches. String matches that
+// have already been reported by a previous call are left out. In the
+// returned matches, Base is set to the stream offset of the scanned
+// window, so Base+Offset is the match's offset within the stream.
+// StringMatchCounts only counts the string matches that are returned.
+//
+// Rules without string matches are reported by every Scan during which
+// their condition is satisfied.
+func (g *GrowingScanner) Scan() (matches MatchRules, err error) {
+	if g.Offset() == g.scanned {
+		return nil, nil
+	}
+	var m MatchRules
+	if err = g.rules.ScanMem(g.buf, g.Flags, g.Timeout, &m); err != nil {
+		return nil, err
+	}
+	for _, mr := range m {
+		strs := mr.Strings[:0]
+		for _, ms := range mr.Strings {
+			ms.Base = uint64(g.base)
+			key := streamMatch{mr.Namespace, mr.Rule, ms.Name, g.base + int64(ms.Offset)}
+			if !g.reported[key] {
+				g.reported[key] = true
+				strs = append(strs, ms)
+			}
+		}
+		if len(mr.Strings) > 0 && len(strs) == 0 {
+			continue
+		}
+		mr.Strings = strs
+		mr.StringMatchCounts = nil
+		if len(strs) > 0 {
+			mr.StringMatchCounts = make(map[string]int)
+			for _, ms := range strs {
+				mr.StringMatchCounts[ms.Name]++
+			}
+		}
+		matches = append(matches, mr)
+	}
+	g.scanned = g.Offset()
+	if len(g.buf) > g.overlap {
+		g.base += int64(len(g.buf) - g.overlap)
+		g.buf = append(g.buf[:0], g.buf[len(g.buf)-g.overlap:]...)
+		for key := range g.reported {
+			if key.offset < g.base {
+				delete(g.reported, key)
+			}
+		}
+	}
+	return matches, nil
+}
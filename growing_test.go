@@ -0,0 +1,91 @@
+// Copyright © 2015-2020 Hilko Bengen <bengen@hilluzination.de>
+// All rights reserved.
+//
+// Use of this source code is governed by the license that can be
+// found in the LICENSE file.
+
+package yara
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGrowingScanner(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = "needle" condition: $a }`)
+	g, err := NewGrowingScanner(r, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, step := range []struct {
+		data    string
+		offsets []uint64
+	}{
+		{"xxxxneedlexx", []uint64{4}},
+		{strings.Repeat("x", 20) + "nee", nil},
+		{"dle", []uint64{32}},
+		{"", nil},
+		{"needle", []uint64{38}},
+	} {
+		g.Write([]byte(step.data))
+		m, err := g.Scan()
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		var offsets []uint64
+		for _, mr := range m {
+			for _, ms := range mr.Strings {
+				offsets = append(offsets, ms.Base+ms.Offset)
+			}
+		}
+		if len(offsets) != len(step.offsets) {
+			t.Errorf("step %d: expected matches at %v, got %v", i, step.offsets, offsets)
+			continue
+		}
+		for j := range offsets {
+			if offsets[j] != step.offsets[j] {
+				t.Errorf("step %d: expected matches at %v, got %v", i, step.offsets, offsets)
+			}
+		}
+	}
+	if g.Offset() != 44 {
+		t.Errorf("expected offset 44, got %d", g.Offset())
+	}
+}
+
+func TestGrowingScannerDedup(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = /ab+/ $b = "cd" condition: any of them }`)
+	g, err := NewGrowingScanner(r, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []uint64
+	for _, data := range []string{"xxab", "bbbcd", "xxxxxxxxxx"} {
+		g.Write([]byte(data))
+		m, err := g.Scan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mr := range m {
+			counts := make(map[string]int)
+			for _, ms := range mr.Strings {
+				offsets = append(offsets, ms.Base+ms.Offset)
+				counts[ms.Name]++
+			}
+			if !reflect.DeepEqual(mr.StringMatchCounts, counts) {
+				t.Errorf("expected string match counts %v, got %v", counts, mr.StringMatchCounts)
+			}
+		}
+	}
+	if len(offsets) != 2 || offsets[0] != 2 || offsets[1] != 7 {
+		t.Errorf("expected matches at [2 7], got %v", offsets)
+	}
+}
+
+func TestGrowingScannerNegativeOverlap(t *testing.T) {
+	r := makeRules(t, `rule t { condition: true }`)
+	if g, err := NewGrowingScanner(r, -1); err == nil {
+		t.Errorf("expected error for negative overlap, got %+v", g)
+	}
+}
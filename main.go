@@ -11,6 +11,10 @@ package yara
 #include <yara.h>
 */
 import "C"
+import (
+	"errors"
+	"sync"
+)
 
 func init() {
 	if err := initialize(); err != nil {
@@ -18,9 +22,44 @@ func init() {
 	}
 }
 
+// initState counts the references to libyara that have been taken
+// by this package, including the one taken during package
+// initialization.
+var initState struct {
+	sync.Mutex
+	refs int
+}
+
+// ErrNotInitialized is returned by Finalize if it is called more often
+// than Initialize.
+var ErrNotInitialized = errors.New("library has not been initialized")
+
 // Prepares the library to be used.
 func initialize() error {
-	return newError(C.yr_initialize())
+	initState.Lock()
+	defer initState.Unlock()
+	if err := newError(C.yr_initialize()); err != nil {
+		return err
+	}
+	initState.refs++
+	return nil
+}
+
+// Version returns the version of libyara that the package has been
+// built with, e.g. "4.0.5".
+func Version() string {
+	return C.YR_VERSION
+}
+
+// Initialize takes an additional reference to the YARA library. Every
+// call to Initialize must be balanced by a call to Finalize.
+//
+// libyara counts calls to yr_initialize and yr_finalize and only
+// releases its resources once the count drops to zero, so nested
+// Initialize/Finalize pairs, also by other users of libyara within the
+// same process, are safe.
+func Initialize() error {
+	return initialize()
 }
 
 // Finalize releases all the resources allocated by the YARA library.
@@ -33,6 +72,20 @@ func initialize() error {
 // A good practice is calling Finalize as a deferred function in the
 // program's main function:
 //     defer yara.Finalize()
+//
+// Finalize drops one reference taken by Initialize or by the package
+// initialization; only the last call actually tears down the library,
+// which must not happen while scans are in progress. ErrNotInitialized
+// is returned if all references have already been dropped.
 func Finalize() error {
-	return newError(C.yr_finalize())
+	initState.Lock()
+	defer initState.Unlock()
+	if initState.refs == 0 {
+		return ErrNotInitialized
+	}
+	if err := newError(C.yr_finalize()); err != nil {
+		return err
+	}
+	initState.refs--
+	return nil
 }
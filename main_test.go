@@ -36,3 +36,26 @@ func TestMain(m *testing.M) {
 	os.Remove(compiledTestRulesPath)
 	os.Exit(rc)
 }
+
+func TestNestedInitialize(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		if err := Initialize(); err != nil {
+			t.Fatalf("Initialize #%d: %v", i+1, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := Finalize(); err != nil {
+			t.Fatalf("Finalize #%d: %v", i+1, err)
+		}
+	}
+	// The reference taken during package initialization is still
+	// held, so the library remains usable.
+	r := makeRules(t, `rule t { condition: true }`)
+	var m MatchRules
+	if err := r.ScanMem([]byte(""), 0, 0, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Errorf("unexpected matches: %+v", m)
+	}
+}
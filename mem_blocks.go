@@ -19,6 +19,7 @@ YR_MEMORY_BLOCK* memoryBlockIteratorNext(YR_MEMORY_BLOCK_ITERATOR*);
 */
 import "C"
 import (
+	"io"
 	"reflect"
 	"unsafe"
 )
@@ -26,6 +27,13 @@ import (
 // MemoryBlockIterator is a Go representation of YARA's
 // YR_MEMORY_BLOCK_ITERATOR mechanism that is used within
 // yr_rules_mem_scan_blobs.
+//
+// Implementations can be passed to (*Rules).ScanMemBlocks or
+// (*Scanner).ScanMemBlocks to scan data that is not available as a
+// single contiguous buffer, e.g. remote memory or custom memory
+// layouts. First and Next return the respective block, or nil once
+// all blocks have been returned. The data of a block is only
+// requested through its FetchData function if libyara needs it.
 type MemoryBlockIterator interface {
 	First() *MemoryBlock
 	Next() *MemoryBlock
@@ -43,6 +51,30 @@ type memoryBlockIteratorContainer struct {
 	// YARA. Its backing array lives in malloc memory and will only be
 	// resized using the realloc method.
 	buf []byte
+	// onBlock, if set, receives the blocks that are returned by First
+	// and Next until the first walk over the blocks has finished.
+	onBlock  func(*ScanContext, int64, int)
+	blockCtx *ScanContext
+	walked   bool
+}
+
+// setBlockCallback arranges for the blocks of the scan to be reported
+// to cb if it implements ScanCallbackBlock.
+func (c *memoryBlockIteratorContainer) setBlockCallback(cb ScanCallback, sc *ScanContext) {
+	c.onBlock, c.blockCtx = blockScanned(cb), sc
+}
+
+// reportBlock passes the current block to onBlock during the first
+// walk over the blocks, i.e. while libyara searches them for strings.
+func (c *memoryBlockIteratorContainer) reportBlock() {
+	if c.onBlock == nil || c.walked {
+		return
+	}
+	if c.MemoryBlock == nil {
+		c.walked = true
+		return
+	}
+	c.onBlock(c.blockCtx, int64(c.MemoryBlock.Base), int(c.MemoryBlock.Size))
 }
 
 func makeMemoryBlockIteratorContainer(mbi MemoryBlockIterator) (c *memoryBlockIteratorContainer) {
@@ -85,6 +117,13 @@ func (c *memoryBlockIteratorContainer) free() {
 }
 
 // MemoryBlock is returned by the MemoryBlockIterator's First and Next methods
+//
+// Offsets of string matches are reported relative to Base, so blocks
+// of a memory dump can be passed with their original addresses.
+// libyara has no per-block flags: ScanFlagsProcessMemory applies to
+// all blocks of a scan. Dumps that mix file-backed and anonymous
+// regions have to be scanned in two passes, one of them with
+// ScanFlagsProcessMemory.
 type MemoryBlock struct {
 	// Base contains the base address of the current block
 	Base uint64
@@ -136,6 +175,7 @@ func memoryBlockIteratorCommon(cmbi *C.YR_MEMORY_BLOCK_ITERATOR, c *memoryBlockI
 func memoryBlockIteratorFirst(cmbi *C.YR_MEMORY_BLOCK_ITERATOR) *C.YR_MEMORY_BLOCK {
 	c := callbackData.Get(cmbi.context).(*memoryBlockIteratorContainer)
 	c.MemoryBlock = c.MemoryBlockIterator.First()
+	c.reportBlock()
 	return memoryBlockIteratorCommon(cmbi, c)
 }
 
@@ -146,5 +186,50 @@ func memoryBlockIteratorFirst(cmbi *C.YR_MEMORY_BLOCK_ITERATOR) *C.YR_MEMORY_BLO
 func memoryBlockIteratorNext(cmbi *C.YR_MEMORY_BLOCK_ITERATOR) *C.YR_MEMORY_BLOCK {
 	c := callbackData.Get(cmbi.context).(*memoryBlockIteratorContainer)
 	c.MemoryBlock = c.MemoryBlockIterator.Next()
+	c.reportBlock()
 	return memoryBlockIteratorCommon(cmbi, c)
 }
+
+// RangeReaderBlockSize is the size of the blocks in which
+// (*Rules).ScanRangeReader reads its input.
+var RangeReaderBlockSize int64 = 1 << 20
+
+// readerAtIterator is a MemoryBlockIterator that reads blocks of
+// RangeReaderBlockSize bytes from an io.ReaderAt. The first error
+// returned by ReadAt is recorded in err.
+type readerAtIterator struct {
+	ra        io.ReaderAt
+	size      int64
+	blockSize int64
+	offset    int64
+	err       error
+}
+
+func (it *readerAtIterator) First() *MemoryBlock {
+	it.offset = 0
+	return it.Next()
+}
+
+func (it *readerAtIterator) Next() *MemoryBlock {
+	if it.offset >= it.size {
+		return nil
+	}
+	base, size := it.offset, it.size-it.offset
+	if size > it.blockSize {
+		size = it.blockSize
+	}
+	it.offset += size
+	return &MemoryBlock{
+		Base: uint64(base),
+		Size: uint64(size),
+		FetchData: func(buf []byte) {
+			n, err := it.ra.ReadAt(buf, base)
+			if err == io.EOF && n == len(buf) {
+				err = nil
+			}
+			if err != nil && it.err == nil {
+				it.err = err
+			}
+		},
+	}
+}
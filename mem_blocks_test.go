@@ -7,6 +7,8 @@
 package yara
 
 import (
+	"bytes"
+	"io"
 	"testing"
 )
 
@@ -76,3 +78,152 @@ condition: $a at 0 and $b at 32
 		t.Logf("simple iterator scan (aaa..bbb): %+v", mrs)
 	}
 }
+
+func TestScanRangeReader(t *testing.T) {
+	defer func(size int64) { RangeReaderBlockSize = size }(RangeReaderBlockSize)
+	RangeReaderBlockSize = 16
+	rs := MustCompile(`
+rule t {
+strings: $a = "aaaa" $b = "bbbb"
+condition: $a at 0 and $b at 32
+}`, nil)
+	data := []byte("aaaaaaaaaaaaaaaa................bbbbbbbbbbbbbbbb")
+	var mrs MatchRules
+	if err := rs.ScanRangeReader(bytes.NewReader(data), int64(len(data)), 0, 0, &mrs); err != nil {
+		t.Fatal(err)
+	}
+	if len(mrs) != 1 {
+		t.Errorf("unexpected matches: %+v", mrs)
+	}
+	mrs = nil
+	if err := rs.ScanRangeReader(bytes.NewReader(data), int64(len(data))+8, 0, 0, &mrs); err != io.EOF {
+		t.Errorf("size beyond end of data: expected io.EOF, got %v", err)
+	}
+}
+
+func TestIteratorOffsets(t *testing.T) {
+	rs := MustCompile(`rule t { strings: $a = "abcd" condition: $a }`, nil)
+	var mrs MatchRules
+	if err := rs.ScanMemBlocks(&testIter{
+		data: []block{
+			{0x1000, []byte("..abcd..")},
+			{0x7f0000, []byte("abcd")},
+		},
+	}, 0, 0, &mrs); err != nil {
+		t.Fatal(err)
+	}
+	if len(mrs) != 1 || len(mrs[0].Strings) != 2 {
+		t.Fatalf("unexpected matches: %+v", mrs)
+	}
+	for i, expected := range []struct{ base, offset uint64 }{{0x1000, 2}, {0x7f0000, 0}} {
+		ms := mrs[0].Strings[i]
+		if ms.Base != expected.base || ms.Offset != expected.offset {
+			t.Errorf("match %d: expected base %#x, offset %d, got %#x, %d",
+				i, expected.base, expected.offset, ms.Base, ms.Offset)
+		}
+	}
+}
+
+func TestIteratorContextBytes(t *testing.T) {
+	rs := MustCompile(`rule t { strings: $a = "abcd" condition: $a }`, nil)
+	var mrs MatchRules
+	it := &countingIter{testIter: testIter{data: []block{
+		{0x1000, []byte("..abcd..")},
+		{0x2000, []byte("xyabcdzz")},
+		{0x2008, []byte("ww")},
+	}}}
+	if err := rs.ScanMemBlocks(it, 0, 0, mrs.Collector().SetContextBytes(4)); err != nil {
+		t.Fatal(err)
+	}
+	if len(mrs) != 1 || len(mrs[0].Strings) != 2 {
+		t.Fatalf("unexpected matches: %+v", mrs)
+	}
+	// The context does not extend to the previous block but continues
+	// into the following block if it is adjacent.
+	for i, expected := range []struct {
+		context string
+		offset  int
+	}{{"..abcd..", 2}, {"xyabcdzzww", 2}} {
+		ms := mrs[0].Strings[i]
+		if string(ms.Context) != expected.context || ms.ContextOffset != expected.offset {
+			t.Errorf("match %d: expected context %q at %d, got %q at %d",
+				i, expected.context, expected.offset, ms.Context, ms.ContextOffset)
+		}
+	}
+	if it.first < 3 {
+		t.Errorf("expected the iterator to be restarted for every match, First called %d times", it.first)
+	}
+}
+
+type blockCounter struct {
+	MatchRules
+	bases []int64
+	bytes int
+}
+
+func (c *blockCounter) BlockScanned(_ *ScanContext, base int64, size int) {
+	c.bases = append(c.bases, base)
+	c.bytes += size
+}
+
+func TestScanCallbackBlock(t *testing.T) {
+	rs := MustCompile(`rule t { strings: $a = "aaaa" $b = "bbbb" condition: $a and $b }`, nil)
+	cb := &blockCounter{}
+	if err := rs.ScanMemBlocks(&testIter{
+		data: []block{
+			{0, []byte("aaaaaaaaaaaaaaaa")},
+			{32, []byte("bbbbbbbbbbbbbbbb")},
+			{64, []byte("cccccccc")},
+		},
+	}, 0, 0, cb); err != nil {
+		t.Fatal(err)
+	}
+	if len(cb.MatchRules) != 1 {
+		t.Errorf("expected 1 match, got %+v", cb.MatchRules)
+	}
+	if len(cb.bases) != 3 || cb.bases[0] != 0 || cb.bases[1] != 32 || cb.bases[2] != 64 || cb.bytes != 40 {
+		t.Errorf("unexpected blocks: bases=%v, bytes=%d", cb.bases, cb.bytes)
+	}
+	cb = &blockCounter{}
+	if err := rs.ScanMem([]byte("aaaa bbbb"), 0, 0, cb); err != nil {
+		t.Fatal(err)
+	}
+	if len(cb.bases) != 1 || cb.bytes != 9 {
+		t.Errorf("ScanMem: unexpected blocks: bases=%v, bytes=%d", cb.bases, cb.bytes)
+	}
+}
+
+type countingIter struct {
+	testIter
+	first int
+}
+
+func (it *countingIter) First() *MemoryBlock {
+	it.first++
+	return it.testIter.First()
+}
+
+func TestScanCallbackBlockMultiCallback(t *testing.T) {
+	rs := MustCompile(`rule t { strings: $a = "aaaa" condition: $a }`, nil)
+	data := []block{{0, []byte("aaaaaaaa")}, {32, []byte("bbbbbbbb")}}
+	var m MatchRules
+	it := &countingIter{testIter: testIter{data: data}}
+	if err := rs.ScanMemBlocks(it, 0, 0, MultiCallback{&m, ModuleData{}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Errorf("expected 1 match, got %+v", m)
+	}
+	if it.first != 1 {
+		t.Errorf("expected First to be called once, got %d", it.first)
+	}
+
+	cb := &blockCounter{}
+	it = &countingIter{testIter: testIter{data: data}}
+	if err := rs.ScanMemBlocks(it, 0, 0, MultiCallback{ModuleData{}, cb}); err != nil {
+		t.Fatal(err)
+	}
+	if it.first != 1 || len(cb.bases) != 2 || cb.bytes != 16 {
+		t.Errorf("unexpected blocks: First called %d times, bases=%v, bytes=%d", it.first, cb.bases, cb.bytes)
+	}
+}
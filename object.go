@@ -8,7 +8,110 @@ package yara
 
 /*
 #include <yara.h>
+
+// object_integer is a union accessor function.
+// (CGO does not represent them properly to Go code.)
+static int64_t object_integer(YR_OBJECT* o) {
+	return o->value.i;
+}
+
+// object_string is a union accessor function.
+static SIZED_STRING* object_string(YR_OBJECT* o) {
+	return o->value.ss;
+}
+
+// object_dictionary_length returns the number of items stored in a
+// dictionary object.
+static int object_dictionary_length(YR_OBJECT* o) {
+	YR_DICTIONARY_ITEMS* items = object_as_dictionary(o)->items;
+	return items == NULL ? 0 : items->used;
+}
 */
 import "C"
+import "unsafe"
 
+// Object represents a YARA object, such as the structure that is
+// populated by a module or one of its members.
+//
+// Objects are owned by the scan context, they must not be used after
+// the callback method that received them has returned.
+//
+// Functions exported by modules, such as pe.imphash(), cannot be
+// called through Object: libyara only calls them while evaluating
+// rule conditions. Their results can be used by comparing them within
+// rules, e.g. pe.imphash() == "…", possibly against external
+// variables that are defined for every scan.
 type Object struct{ cptr *C.YR_OBJECT }
+
+// Identifier returns the object's name.
+func (o *Object) Identifier() string {
+	return C.GoString(o.cptr.identifier)
+}
+
+// Field returns the named member of a structure object.
+func (o *Object) Field(name string) (*Object, bool) {
+	if o.cptr._type != C.OBJECT_TYPE_STRUCTURE {
+		return nil, false
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	ptr := C.yr_object_lookup_field(o.cptr, cname)
+	if ptr == nil {
+		return nil, false
+	}
+	return &Object{ptr}, true
+}
+
+// Integer returns the value of an integer object. If the object is
+// not an integer or its value is undefined, false is returned.
+func (o *Object) Integer() (int64, bool) {
+	if o.cptr._type != C.OBJECT_TYPE_INTEGER {
+		return 0, false
+	}
+	i := C.object_integer(o.cptr)
+	if uint64(i) == uint64(C.YR_UNDEFINED) {
+		return 0, false
+	}
+	return int64(i), true
+}
+
+// StringValue returns the value of a string object. If the object is
+// not a string or its value is undefined, false is returned.
+func (o *Object) StringValue() (string, bool) {
+	if o.cptr._type != C.OBJECT_TYPE_STRING {
+		return "", false
+	}
+	ss := C.object_string(o.cptr)
+	if ss == nil {
+		return "", false
+	}
+	return C.GoStringN(&ss.c_string[0], C.int(ss.length)), true
+}
+
+// Length returns the number of elements of an array or dictionary
+// object. For arrays, this is the highest index that has been set,
+// plus one. If the object is neither an array nor a dictionary, false
+// is returned.
+func (o *Object) Length() (int, bool) {
+	switch o.cptr._type {
+	case C.OBJECT_TYPE_ARRAY:
+		return int(C.yr_object_array_length(o.cptr)), true
+	case C.OBJECT_TYPE_DICTIONARY:
+		return int(C.object_dictionary_length(o.cptr)), true
+	}
+	return 0, false
+}
+
+// Item returns the element of an array object at index i. If the
+// object is not an array or the element has not been set, false is
+// returned.
+func (o *Object) Item(i int) (*Object, bool) {
+	if o.cptr._type != C.OBJECT_TYPE_ARRAY || i < 0 {
+		return nil, false
+	}
+	ptr := C.yr_object_array_get_item(o.cptr, 0, C.int(i))
+	if ptr == nil {
+		return nil, false
+	}
+	return &Object{ptr}, true
+}
@@ -344,6 +344,12 @@ func TestFilesize(t *testing.T) {
 	assertTrueRules(t, []string{
 		fmt.Sprintf("rule test { condition: filesize == %d }", len(pe32file)),
 	}, pe32file)
+	assertTrueRules(t, []string{
+		"rule test { condition: filesize == 10 }",
+	}, []byte("0123456789"))
+	assertFalseRules(t, []string{
+		"rule test { condition: filesize == 10 }",
+	}, []byte("012345678"))
 }
 
 // TODO: TestCompileFile
@@ -0,0 +1,160 @@
+// Copyright © 2015-2020 Hilko Bengen <bengen@hilluzination.de>
+// All rights reserved.
+//
+// Use of this source code is governed by the license that can be
+// found in the LICENSE file.
+
+package yara
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MetaType identifies the type of a MetaValue.
+type MetaType int
+
+const (
+	// MetaTypeNull is used for meta values of unknown type.
+	MetaTypeNull MetaType = iota
+	// MetaTypeString means that MetaValue.S is set.
+	MetaTypeString
+	// MetaTypeInteger means that MetaValue.I is set.
+	MetaTypeInteger
+	// MetaTypeBoolean means that MetaValue.B is set.
+	MetaTypeBoolean
+)
+
+// MetaValue represents the value of a meta variable without using
+// interface types. Only the field that corresponds to Type is set.
+type MetaValue struct {
+	Type MetaType
+	S    string
+	I    int64
+	B    bool
+}
+
+// ResultMeta is the representation of a Meta within a Result.
+type ResultMeta struct {
+	Identifier string
+	Value      MetaValue
+}
+
+// Result is a representation of a matching rule that only consists
+// of primitive types, slices, and nested structs, so that it can be
+// mapped to serialization formats such as protocol buffers without
+// reflection.
+//
+// Rules, metas, strings, and string matches appear in the order in
+// which libyara stores them, so scanning identical data with the same
+// ruleset yields identical Results.
+type Result struct {
+	Rule      string
+	Namespace string
+	Tags      []string
+	Metas     []ResultMeta
+	Strings   []MatchString
+	FastMode  bool
+	Source    string
+	DataHash  string
+}
+
+// MetaValue returns the meta variable's value as a MetaValue.
+func (m Meta) MetaValue() MetaValue {
+	switch v := m.Value.(type) {
+	case string:
+		return MetaValue{Type: MetaTypeString, S: v}
+	case int:
+		return MetaValue{Type: MetaTypeInteger, I: int64(v)}
+	case bool:
+		return MetaValue{Type: MetaTypeBoolean, B: v}
+	}
+	return MetaValue{}
+}
+
+// Result converts the MatchRule to a Result.
+func (mr *MatchRule) Result() Result {
+	res := Result{
+		Rule:      mr.Rule,
+		Namespace: mr.Namespace,
+		Tags:      mr.Tags,
+		Strings:   mr.Strings,
+		FastMode:  mr.FastMode,
+		Source:    mr.Source,
+		DataHash:  mr.DataHash,
+	}
+	for _, m := range mr.Metas {
+		res.Metas = append(res.Metas, ResultMeta{m.Identifier, m.MetaValue()})
+	}
+	return res
+}
+
+// Results converts all MatchRule objects to Result objects.
+func (mr MatchRules) Results() (results []Result) {
+	for i := range mr {
+		results = append(results, mr[i].Result())
+	}
+	return
+}
+
+// SortBySeverity sorts the matching rules by the integer meta
+// variable metaKey in descending order. Rules that lack the meta
+// variable, or where it is not an integer, are sorted last. The
+// original order is kept for rules with equal severity.
+func (mr MatchRules) SortBySeverity(metaKey string) {
+	severity := func(r *MatchRule) (int, bool) {
+		for _, m := range r.Metas {
+			if m.Identifier == metaKey {
+				v, ok := m.Value.(int)
+				return v, ok
+			}
+		}
+		return 0, false
+	}
+	sort.SliceStable(mr, func(i, j int) bool {
+		si, oki := severity(&mr[i])
+		sj, okj := severity(&mr[j])
+		if oki != okj {
+			return oki
+		}
+		return si > sj
+	})
+}
+
+// matchKey identifies a MatchRule by its namespace, identifier, and
+// the names and positions of its matched strings.
+func matchKey(mr *MatchRule) string {
+	parts := make([]string, 0, len(mr.Strings)+1)
+	parts = append(parts, mr.Namespace+":"+mr.Rule)
+	for _, ms := range mr.Strings {
+		parts = append(parts, fmt.Sprintf("%s@%d", ms.Name, ms.Base+ms.Offset))
+	}
+	sort.Strings(parts[1:])
+	return strings.Join(parts, " ")
+}
+
+// DiffMatches compares two sets of matches, e.g. from scanning the
+// same data using an old and a new version of a ruleset. Matches are
+// compared by namespace, rule identifier, and the names and offsets
+// of the matched strings; a rule whose string matches differ is
+// reported as both removed and added.
+func DiffMatches(old, new MatchRules) (added, removed MatchRules) {
+	return subtractMatches(new, old), subtractMatches(old, new)
+}
+
+// subtractMatches returns the elements of a that are not part of b.
+func subtractMatches(a, b MatchRules) (diff MatchRules) {
+	count := make(map[string]int)
+	for i := range b {
+		count[matchKey(&b[i])]++
+	}
+	for i := range a {
+		if k := matchKey(&a[i]); count[k] > 0 {
+			count[k]--
+		} else {
+			diff = append(diff, a[i])
+		}
+	}
+	return
+}
@@ -77,6 +77,12 @@ static const char* string_identifier(YR_STRING* s) {
 	return s->identifier;
 }
 
+// string_value is a union accessor function.
+// (CGO does not represent them properly to Go code.)
+static const uint8_t* string_value(YR_STRING* s) {
+	return s->string;
+}
+
 // string_matches returns pointers to the string match objects
 // associated with a string, using YARA's macro-based implementation.
 static void string_matches(YR_SCAN_CONTEXT *ctx, YR_STRING* s, const YR_MATCH *matches[], int *n) {
@@ -105,9 +111,42 @@ static void get_rules(YR_RULES *ruleset, const YR_RULE *rules[], int *n) {
 	return;
 }
 
+// rules_externals returns pointers to the external variables
+// declared for a ruleset.
+static void rules_externals(YR_RULES *ruleset, const YR_EXTERNAL_VARIABLE *externals[], int *n) {
+	const YR_EXTERNAL_VARIABLE *external;
+	int i = 0;
+	for (external = ruleset->externals_list_head;
+	     !EXTERNAL_VARIABLE_IS_NULL(external);
+	     external++) {
+		if (i < *n)
+			externals[i] = external;
+		i++;
+	}
+	*n = i;
+	return;
+}
+
+// external_get is a union accessor function.
+// (CGO does not represent them properly to Go code.)
+static void external_get(YR_EXTERNAL_VARIABLE *e, const char** identifier, int64_t* i, double* f, const char** s) {
+	*identifier = e->identifier;
+	*i = e->value.i;
+	*f = e->value.f;
+	*s = e->value.s;
+	return;
+}
+
 */
 import "C"
-import "unsafe"
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"unsafe"
+)
 
 // Rule represents a single rule as part of a ruleset.
 type Rule struct {
@@ -143,13 +182,19 @@ func (r *Rule) Tags() (tags []string) {
 
 // Meta represents a rule meta variable. Value can be of type string,
 // int, boolean, or nil.
+//
+// libyara does not support floating-point meta values; rules that
+// use them are rejected by the compiler. Values of meta types unknown
+// to this package are represented as nil.
 type Meta struct {
 	Identifier string
 	Value      interface{}
 }
 
 // Metas returns the rule's meta variables as a list of Meta
-// objects.
+// objects. Meta variables appear in the order of their declaration;
+// if an identifier is declared several times, e.g. multiple
+// reference metas, every occurrence is returned.
 func (r *Rule) Metas() (metas []Meta) {
 	var size C.int
 	C.rule_metas(r.cptr, nil, &size)
@@ -162,20 +207,37 @@ func (r *Rule) Metas() (metas []Meta) {
 		var cid, cstr *C.char
 		C.meta_get(cptr, &cid, &cstr)
 		id := C.GoString(cid)
-		var val interface{}
-		switch cptr._type {
-		case C.META_TYPE_STRING:
-			val = C.GoString(cstr)
-		case C.META_TYPE_INTEGER:
-			val = int(cptr.integer)
-		case C.META_TYPE_BOOLEAN:
-			val = (cptr.integer != 0)
-		}
-		metas = append(metas, Meta{id, val})
+		metas = append(metas, Meta{id, metaValue(int(cptr._type), cstr, int64(cptr.integer))})
 	}
 	return
 }
 
+// metaValue converts the value of a meta variable of libyara type
+// typ. It returns nil for unknown types.
+func metaValue(typ int, str *C.char, integer int64) interface{} {
+	switch typ {
+	case C.META_TYPE_STRING:
+		return C.GoString(str)
+	case C.META_TYPE_INTEGER:
+		return int(integer)
+	case C.META_TYPE_BOOLEAN:
+		return integer != 0
+	}
+	return nil
+}
+
+// hasAnyTag returns true if the rule carries at least one of tags.
+func (r *Rule) hasAnyTag(tags []string) bool {
+	for _, t := range r.Tags() {
+		for _, tag := range tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // IsPrivate returns true if the rule is marked as private.
 func (r *Rule) IsPrivate() bool {
 	return r.cptr.flags&C.RULE_FLAGS_PRIVATE != 0
@@ -186,11 +248,60 @@ func (r *Rule) IsGlobal() bool {
 	return r.cptr.flags&C.RULE_FLAGS_GLOBAL != 0
 }
 
+// Flags returns the raw flags of the rule, as stored in YR_RULE.flags,
+// for flags that are not modeled by this package. The bits known to
+// YARA 4.0 are:
+//
+//	0x01  RULE_FLAGS_PRIVATE   the rule is private (see IsPrivate)
+//	0x02  RULE_FLAGS_GLOBAL    the rule is global (see IsGlobal)
+//	0x04  RULE_FLAGS_NULL      the rule has no condition code (internal)
+//	0x08  RULE_FLAGS_DISABLED  the rule has been disabled using Disable
+//
+// Other versions of libyara may define different bits.
+func (r *Rule) Flags() uint32 {
+	return uint32(r.cptr.flags)
+}
+
+// String returns a compact representation of the rule, suitable for
+// logging, in the form
+//
+//	namespace:identifier [tag1 tag2] {meta1="value", meta2=1}
+//
+// Tags and metas are omitted if the rule has none.
+func (r *Rule) String() string {
+	var b strings.Builder
+	b.WriteString(r.Namespace())
+	b.WriteByte(':')
+	b.WriteString(r.Identifier())
+	if tags := r.Tags(); len(tags) > 0 {
+		b.WriteString(" [")
+		b.WriteString(strings.Join(tags, " "))
+		b.WriteByte(']')
+	}
+	if metas := r.Metas(); len(metas) > 0 {
+		b.WriteString(" {")
+		for i, m := range metas {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			if s, ok := m.Value.(string); ok {
+				fmt.Fprintf(&b, "%s=%q", m.Identifier, s)
+			} else {
+				fmt.Fprintf(&b, "%s=%v", m.Identifier, m.Value)
+			}
+		}
+		b.WriteByte('}')
+	}
+	return b.String()
+}
+
 // String represents a string as part of a rule.
 type String struct {
 	cptr *C.YR_STRING
 	// Save underlying YR_RULES from being discarded through GC
 	rules *Rules
+	// The rule that the string belongs to, if known
+	rule *C.YR_RULE
 }
 
 // Strings returns the rule's strings.
@@ -203,16 +314,155 @@ func (r *Rule) Strings() (strs []String) {
 	ptrs := make([]*C.YR_STRING, int(size))
 	C.rule_strings(r.cptr, &ptrs[0], &size)
 	for _, ptr := range ptrs {
-		strs = append(strs, String{ptr, r.rules})
+		strs = append(strs, String{ptr, r.rules, r.cptr})
 	}
 	return
 }
 
+// NumStrings returns the number of strings declared in the rule.
+func (r *Rule) NumStrings() int {
+	var size C.int
+	C.rule_strings(r.cptr, nil, &size)
+	return int(size)
+}
+
+// NumAtoms returns the number of atoms that the compiler has
+// generated for the rule's strings. A large number of atoms usually
+// indicates strings that slow down scanning. (The atoms' quality is
+// not retained in compiled rules.)
+func (r *Rule) NumAtoms() int {
+	return int(r.cptr.num_atoms)
+}
+
 // Identifier returns the string's name.
 func (s *String) Identifier() string {
 	return C.GoString(C.string_identifier(s.cptr))
 }
 
+// Rule returns the rule that the string belongs to. For strings that
+// have not been obtained through (*Rule).Strings, the ruleset is
+// searched.
+func (s *String) Rule() *Rule {
+	if s.rule == nil && s.rules != nil {
+	search:
+		for _, r := range s.rules.GetRules() {
+			for _, str := range r.Strings() {
+				if str.cptr == s.cptr {
+					s.rule = r.cptr
+					break search
+				}
+			}
+		}
+	}
+	if s.rule == nil {
+		return nil
+	}
+	return &Rule{s.rule, s.rules}
+}
+
+// IsFullword returns true if the string has the fullword modifier.
+func (s *String) IsFullword() bool {
+	return s.cptr.flags&C.STRING_FLAGS_FULL_WORD != 0
+}
+
+// IsBase64 returns true if the string has the base64 or base64wide
+// modifier.
+//
+// YARA does not retain custom base64 alphabets in compiled rules, so
+// they cannot be retrieved.
+func (s *String) IsBase64() bool {
+	return s.cptr.flags&(C.STRING_FLAGS_BASE64|C.STRING_FLAGS_BASE64_WIDE) != 0
+}
+
+// IsBase64Wide returns true if the string has the base64wide
+// modifier.
+func (s *String) IsBase64Wide() bool {
+	return s.cptr.flags&C.STRING_FLAGS_BASE64_WIDE != 0
+}
+
+// RuleSummary is a description of a rule that has been reconstructed
+// from its compiled form. It remains valid after the underlying Rules
+// object has been destroyed.
+//
+// Conditions are compiled into bytecode that cannot be converted back
+// to source, so they are not part of the summary.
+type RuleSummary struct {
+	Namespace  string
+	Identifier string
+	Tags       []string
+	Metas      []Meta
+	Strings    []StringSummary
+	Private    bool
+	Global     bool
+}
+
+// StringSummary describes a string as part of a RuleSummary.
+type StringSummary struct {
+	Identifier string
+	// Type is one of "text", "hex", or "regexp".
+	Type string
+	// Value contains the string's value if it is a literal that has
+	// been recorded by the compiler; it is nil otherwise.
+	Value []byte
+	// Modifiers contains the string's modifiers, e.g. "nocase",
+	// "wide", "fullword", in the order in which they appear in YARA's
+	// documentation. Note that the compiler adds an implicit "ascii"
+	// modifier to strings that do not have the "wide" modifier.
+	Modifiers []string
+}
+
+var stringModifiers = []struct {
+	flag uint32
+	name string
+}{
+	{C.STRING_FLAGS_NO_CASE, "nocase"},
+	{C.STRING_FLAGS_ASCII, "ascii"},
+	{C.STRING_FLAGS_WIDE, "wide"},
+	{C.STRING_FLAGS_XOR, "xor"},
+	{C.STRING_FLAGS_BASE64, "base64"},
+	{C.STRING_FLAGS_BASE64_WIDE, "base64wide"},
+	{C.STRING_FLAGS_FULL_WORD, "fullword"},
+	{C.STRING_FLAGS_PRIVATE, "private"},
+}
+
+// Summary returns a description of the string.
+func (s *String) Summary() StringSummary {
+	ss := StringSummary{Identifier: s.Identifier(), Type: "text"}
+	flags := s.cptr.flags
+	switch {
+	case flags&C.STRING_FLAGS_HEXADECIMAL != 0:
+		ss.Type = "hex"
+	case flags&C.STRING_FLAGS_REGEXP != 0:
+		ss.Type = "regexp"
+	}
+	if flags&C.STRING_FLAGS_LITERAL != 0 {
+		ss.Value = C.GoBytes(unsafe.Pointer(C.string_value(s.cptr)), C.int(s.cptr.length))
+	}
+	for _, m := range stringModifiers {
+		if uint32(flags)&m.flag != 0 {
+			ss.Modifiers = append(ss.Modifiers, m.name)
+		}
+	}
+	return ss
+}
+
+// Summary returns a description of the rule that does not reference
+// the compiled ruleset.
+func (r *Rule) Summary() RuleSummary {
+	rs := RuleSummary{
+		Namespace:  r.Namespace(),
+		Identifier: r.Identifier(),
+		Tags:       r.Tags(),
+		Metas:      r.Metas(),
+		Private:    r.IsPrivate(),
+		Global:     r.IsGlobal(),
+	}
+	for _, s := range r.Strings() {
+		rs.Strings = append(rs.Strings, s.Summary())
+	}
+	return rs
+}
+
 // Match represents a string match.
 type Match struct {
 	cptr *C.YR_MATCH
@@ -222,7 +472,7 @@ type Match struct {
 
 // Matches returns all matches that have been recorded for the string.
 func (s *String) Matches(sc *ScanContext) (matches []Match) {
-	if sc == nil || sc.cptr == nil {
+	if !sc.hasData() {
 		return
 	}
 	var size C.int
@@ -238,6 +488,24 @@ func (s *String) Matches(sc *ScanContext) (matches []Match) {
 	return
 }
 
+// UnmatchedStrings returns those of the rule's strings for which no
+// matches have been recorded. It is most useful within the
+// RuleNotMatching method of a ScanCallbackNoMatch implementation,
+// to find out why a rule did not match.
+//
+// Note that a rule may not match even though all of its strings
+// have been found, since the condition may check more than the
+// presence of strings. When ScanFlagsFastMode is set, YARA may stop
+// looking for strings once the condition of a rule has been decided.
+func (r *Rule) UnmatchedStrings(sc *ScanContext) (strs []String) {
+	for _, s := range r.Strings() {
+		if len(s.Matches(sc)) == 0 {
+			strs = append(strs, s)
+		}
+	}
+	return
+}
+
 // Base returns the base offset of the memory block in which the
 // string match occurred.
 func (m *Match) Base() int64 {
@@ -249,19 +517,52 @@ func (m *Match) Offset() int64 {
 	return int64(m.cptr.offset)
 }
 
+// Length returns the length of the string match. It may be larger
+// than the length of the data returned by Data, which is limited by
+// the ConfigMaxMatchData configuration option.
+func (m *Match) Length() int {
+	return int(m.cptr.match_length)
+}
+
 // Data returns the blob of data associated with the string match.
 func (m *Match) Data() []byte {
 	return C.GoBytes(unsafe.Pointer(m.cptr.data), C.int(m.cptr.data_length))
 }
 
-func (r *Rule) getMatchStrings(sc *ScanContext) (matchstrings []MatchString) {
+// dataWith returns a copy of the blob of data associated with the
+// string match, using alloc to allocate the buffer. If alloc is nil,
+// the buffer is allocated using make. If alloc returns a longer
+// slice than requested, it is truncated; if it returns a shorter one,
+// only as much data as fits is copied.
+func (m *Match) dataWith(alloc func(int) []byte) []byte {
+	if alloc == nil {
+		return m.Data()
+	}
+	n := int(m.cptr.data_length)
+	buf := alloc(n)
+	if len(buf) > n {
+		buf = buf[:n]
+	}
+	if len(buf) == 0 {
+		return buf
+	}
+	var data []byte
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+	hdr.Data, hdr.Len, hdr.Cap = uintptr(unsafe.Pointer(m.cptr.data)), len(buf), len(buf)
+	copy(buf, data)
+	return buf
+}
+
+func (r *Rule) getMatchStrings(sc *ScanContext, alloc func(int) []byte) (matchstrings []MatchString) {
 	for _, s := range r.Strings() {
 		for _, m := range s.Matches(sc) {
 			matchstrings = append(matchstrings, MatchString{
 				Name:   s.Identifier(),
 				Base:   uint64(m.Base()),
 				Offset: uint64(m.Offset()),
-				Data:   m.Data(),
+				Length: m.Length(),
+				Data:   m.dataWith(alloc),
+				Base64: s.IsBase64(),
 			})
 		}
 	}
@@ -278,6 +579,10 @@ func (r *Rule) Disable() {
 	C.yr_rule_disable(r.cptr)
 }
 
+func (r *Rule) isEnabled() bool {
+	return r.cptr.flags&C.RULE_FLAGS_DISABLED == 0
+}
+
 // GetRules returns a slice of rule objects that are part of the
 // ruleset.
 func (r *Rules) GetRules() (rules []Rule) {
@@ -293,3 +598,123 @@ func (r *Rules) GetRules() (rules []Rule) {
 	}
 	return
 }
+
+// ExternalVar describes an external variable that has been declared
+// for a ruleset. Type is one of "boolean", "integer", "float", or
+// "string". Value contains the value that has been defined at compile
+// time, as bool, int64, float64, or string.
+type ExternalVar struct {
+	Name  string
+	Type  string
+	Value interface{}
+}
+
+// ExternalVariables returns the external variables that have been
+// declared for the ruleset.
+func (r *Rules) ExternalVariables() (vars []ExternalVar) {
+	var size C.int
+	C.rules_externals(r.cptr, nil, &size)
+	if size == 0 {
+		return
+	}
+	ptrs := make([]*C.YR_EXTERNAL_VARIABLE, int(size))
+	C.rules_externals(r.cptr, &ptrs[0], &size)
+	for _, ptr := range ptrs {
+		var cid, cstr *C.char
+		var i C.int64_t
+		var f C.double
+		C.external_get(ptr, &cid, &i, &f, &cstr)
+		v := ExternalVar{Name: C.GoString(cid)}
+		switch ptr._type {
+		case C.EXTERNAL_VARIABLE_TYPE_BOOLEAN:
+			v.Type, v.Value = "boolean", i != 0
+		case C.EXTERNAL_VARIABLE_TYPE_INTEGER:
+			v.Type, v.Value = "integer", int64(i)
+		case C.EXTERNAL_VARIABLE_TYPE_FLOAT:
+			v.Type, v.Value = "float", float64(f)
+		case C.EXTERNAL_VARIABLE_TYPE_STRING, C.EXTERNAL_VARIABLE_TYPE_MALLOC_STRING:
+			v.Type, v.Value = "string", C.GoString(cstr)
+		}
+		vars = append(vars, v)
+	}
+	runtime.KeepAlive(r)
+	return
+}
+
+// NumAtoms returns the number of atoms that the compiler has
+// generated for all strings in the ruleset. Every variant of a string
+// that results from modifiers such as wide, nocase, or xor needs its
+// own atoms, so the number can be used to estimate the size of the
+// ruleset's Aho-Corasick automaton.
+func (r *Rules) NumAtoms() (n int) {
+	for _, rule := range r.GetRules() {
+		n += rule.NumAtoms()
+	}
+	return
+}
+
+// GlobalRules returns the global rules that are part of the ruleset.
+func (r *Rules) GlobalRules() (rules []Rule) {
+	for _, rule := range r.GetRules() {
+		if rule.IsGlobal() {
+			rules = append(rules, rule)
+		}
+	}
+	return
+}
+
+// RulesWithTag returns the rules of the ruleset that carry tag.
+func (r *Rules) RulesWithTag(tag string) (rules []Rule) {
+	for _, rule := range r.GetRules() {
+		if rule.hasAnyTag([]string{tag}) {
+			rules = append(rules, rule)
+		}
+	}
+	return
+}
+
+// NamespaceCounts returns the number of rules in each of the
+// ruleset's namespaces.
+func (r *Rules) NamespaceCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, rule := range r.GetRules() {
+		counts[rule.Namespace()]++
+	}
+	return counts
+}
+
+// Namespaces returns the sorted list of namespaces that are part of
+// the ruleset.
+func (r *Rules) Namespaces() (namespaces []string) {
+	for ns := range r.NamespaceCounts() {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return
+}
+
+// moduleRecorder is a ScanCallback that records the names of the
+// modules that are imported during a scan.
+type moduleRecorder []string
+
+func (mr *moduleRecorder) RuleMatching(*ScanContext, *Rule) (bool, error) { return false, nil }
+
+func (mr *moduleRecorder) ImportModule(_ *ScanContext, name string) ([]byte, bool, error) {
+	*mr = append(*mr, name)
+	return nil, false, nil
+}
+
+// ImportedModules returns the names of the modules that are imported
+// by the ruleset, in the order in which libyara loads them.
+//
+// libyara does not record which modules are referenced by an
+// individual rule's condition; imports only apply to the ruleset as
+// a whole. The list is determined by scanning an empty buffer, so the
+// modules are loaded once, without any module data.
+func (r *Rules) ImportedModules() ([]string, error) {
+	var mr moduleRecorder
+	if err := r.ScanMem(nil, 0, 0, &mr); err != nil {
+		return nil, err
+	}
+	return mr, nil
+}
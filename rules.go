@@ -37,9 +37,16 @@ int scanCallbackFunc(YR_SCAN_CONTEXT*, int, void*, void*);
 */
 import "C"
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"runtime"
+	"strings"
 	"time"
 	"unsafe"
 )
@@ -58,6 +65,22 @@ type MatchRule struct {
 	Tags      []string
 	Metas     []Meta
 	Strings   []MatchString
+	// StringMatchCounts contains the number of entries in Strings for
+	// each string identifier.
+	StringMatchCounts map[string]int
+	// FastMode is set if the scan was run with ScanFlagsFastMode. In
+	// fast mode, YARA stops looking for a string once it has been
+	// found, so Strings may not contain all of its occurrences.
+	// Fast mode should not be used if offsets of all occurrences are
+	// needed.
+	FastMode bool
+	// Source is an optional name for the scanned data, such as a
+	// file name, that can be set using MatchCollector.SetSource. It
+	// is not used by YARA.
+	Source string
+	// DataHash is the hex-encoded SHA-256 hash of the scanned data if
+	// it has been requested using MatchCollector.SetDataHash.
+	DataHash string
 }
 
 // A MatchString represents a string declared and matched in a rule.
@@ -65,7 +88,60 @@ type MatchString struct {
 	Name   string
 	Base   uint64
 	Offset uint64
+	// Length is the length of the match. Data may be shorter if the
+	// length exceeds the ConfigMaxMatchData configuration option.
+	//
+	// Hex strings containing large jumps are split into a chain of
+	// strings by the compiler. A match of the whole chain is reported
+	// at the offset of its first part, and Length covers all parts
+	// up to the end of the last one.
+	Length int
 	Data   []byte
+	// Base64 is set if the string has the base64 or base64wide
+	// modifier. In this case, Data contains the encoded form.
+	//
+	// Custom alphabets, as in base64("..."), are only used by the
+	// compiler to generate the encoded forms of the string; libyara
+	// does not retain them in compiled rules, so the alphabet that
+	// was used for a match cannot be reported.
+	Base64 bool
+	// Context contains the match and the bytes surrounding it if
+	// MatchCollector.SetContextBytes has been used. It may be shorter
+	// near the start or the end of the data. ContextOffset is the
+	// offset of the match within Context.
+	Context       []byte
+	ContextOffset int
+}
+
+// HexData returns the matched data as a lowercase hex string.
+func (ms MatchString) HexData() string {
+	return hex.EncodeToString(ms.Data)
+}
+
+// PrintableData returns the matched data in the format used by the
+// yara command-line tool's -s option: backslash, newline, carriage
+// return, and tab are written as \\, \n, \r, and \t, other printable
+// ASCII characters are kept as they are, and all other bytes are
+// written as \xNN.
+func (ms MatchString) PrintableData() string {
+	var b strings.Builder
+	for _, c := range ms.Data {
+		switch {
+		case c == '\\':
+			b.WriteString(`\\`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c >= 32 && c <= 126:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\x%02X", c)
+		}
+	}
+	return b.String()
 }
 
 // ScanFlags are used to tweak the behavior of Scan* functions.
@@ -79,6 +155,12 @@ const (
 	// interpreted like live, in-prcess memory rather than an on-disk
 	// file.
 	ScanFlagsProcessMemory = C.SCAN_FLAGS_PROCESS_MEMORY
+	// ScanFlagsNoTryCatch disables YARA's exception handling that
+	// guards against faults (e.g. SIGBUS/SIGSEGV) while accessing the
+	// scanned data. This is only useful for debugging crashes in
+	// rules or modules: with this flag set, such a fault will crash
+	// the entire process.
+	ScanFlagsNoTryCatch = C.SCAN_FLAGS_NO_TRYCATCH
 )
 
 func (sf ScanFlags) withReportFlags(sc ScanCallback) (i C.int) {
@@ -89,21 +171,70 @@ func (sf ScanFlags) withReportFlags(sc ScanCallback) (i C.int) {
 	return
 }
 
+// maxScanBufferSize is the size limit for buffers passed to
+// libyara's scan functions.
+var maxScanBufferSize = uint64(^C.size_t(0))
+
+// checkBufferSize returns ErrBufferTooLarge if buf cannot be passed to
+// libyara without truncating its length.
+func checkBufferSize(buf []byte) error {
+	if uint64(len(buf)) > maxScanBufferSize {
+		return ErrBufferTooLarge
+	}
+	return nil
+}
+
 // ScanMem scans an in-memory buffer using the ruleset.
 // For every event emitted by libyara, the corresponding method on the
 // ScanCallback object is called.
+//
+// ErrBufferTooLarge is returned if buf exceeds the size limit of the
+// platform's size_t type.
+//
+// If the scan times out, ErrScanTimeout is returned. Whatever cb has
+// recorded up to that point is left in place. Note that libyara
+// evaluates the conditions of all rules before reporting any of
+// them, so a scan that runs into the timeout does not report any
+// matching rules; only messages that precede the evaluation of the
+// slow condition, such as module imports, reach cb.
+//
+// If a module fails to load, libyara aborts the scan and the module's
+// error is returned; libyara cannot continue a scan without one of
+// the imported modules. The modules that are part of YARA do not fail
+// on malformed input such as truncated PE files, they leave the
+// affected fields undefined.
 func (r *Rules) ScanMem(buf []byte, flags ScanFlags, timeout time.Duration, cb ScanCallback) (err error) {
+	return r.scanMem(buf, flags, timeout, makeScanCallbackContainer(cb, r))
+}
+
+func (r *Rules) scanMem(buf []byte, flags ScanFlags, timeout time.Duration, cbc *scanCallbackContainer) (err error) {
+	if r.cptr == nil {
+		return ErrRulesReleased
+	}
+	if err = checkScanCallback(cbc.ScanCallback); err != nil {
+		return
+	}
+	if err = checkBufferSize(buf); err != nil {
+		return
+	}
+	if err = startScan(cbc.ScanCallback, &ScanContext{rules: r}); err != nil {
+		return
+	}
+	if f := blockScanned(cbc.ScanCallback); f != nil {
+		f(&ScanContext{rules: r}, 0, len(buf))
+	}
 	var ptr *C.uint8_t
 	if len(buf) > 0 {
 		ptr = (*C.uint8_t)(unsafe.Pointer(&(buf[0])))
 	}
-	id := callbackData.Put(makeScanCallbackContainer(cb, r))
+	defer cbc.finalize()
+	id := callbackData.Put(cbc)
 	defer callbackData.Delete(id)
 	err = newError(C.yr_rules_scan_mem(
 		r.cptr,
 		ptr,
 		C.size_t(len(buf)),
-		flags.withReportFlags(cb),
+		flags.withReportFlags(cbc.ScanCallback),
 		C.YR_CALLBACK_FUNC(C.scanCallbackFunc),
 		id,
 		C.int(timeout/time.Second)))
@@ -111,13 +242,175 @@ func (r *Rules) ScanMem(buf []byte, flags ScanFlags, timeout time.Duration, cb S
 	return
 }
 
+// ScanMemWithModuleData scans an in-memory buffer using the ruleset,
+// passing the contents of moduleData to the modules named by its
+// keys, and returns the matching rules. It is a shortcut for scanning
+// with a MultiCallback that combines MatchRules and ModuleData.
+func (r *Rules) ScanMemWithModuleData(buf []byte, moduleData map[string][]byte, flags ScanFlags, timeout time.Duration) (MatchRules, error) {
+	var m MatchRules
+	if err := r.ScanMem(buf, flags, timeout, MultiCallback{&m, ModuleData(moduleData)}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CountMatches scans an in-memory buffer using the ruleset and
+// returns the number of matching rules. No information about the
+// matches is collected.
+func (r *Rules) CountMatches(buf []byte, flags ScanFlags, timeout time.Duration) (int, error) {
+	cbc := makeScanCallbackContainer(nil, r)
+	if err := r.scanMem(buf, flags, timeout, cbc); err != nil {
+		return 0, err
+	}
+	return cbc.matching, nil
+}
+
+// ScanMemGrouped scans an in-memory buffer using the ruleset and
+// returns the matching rules grouped by namespace. Rules from the
+// default namespace are stored under "default".
+func (r *Rules) ScanMemGrouped(buf []byte, flags ScanFlags, timeout time.Duration) (map[string]MatchRules, error) {
+	var m MatchRules
+	if err := r.ScanMem(buf, flags, timeout, &m); err != nil {
+		return nil, err
+	}
+	groups := make(map[string]MatchRules)
+	for _, mr := range m {
+		ns := mr.Namespace
+		if ns == "" {
+			ns = "default"
+		}
+		groups[ns] = append(groups[ns], mr)
+	}
+	return groups, nil
+}
+
+// ScanTiered scans an in-memory buffer in several passes, one for
+// each tier. A tier is a list of tags; during a pass, only those
+// rules that carry at least one of the tier's tags are enabled. An
+// empty tier selects all rules that carry none of the tags listed in
+// any of the tiers. Scanning stops after the first pass in which at
+// least one rule has matched.
+//
+// Global and private rules are never disabled because other rules
+// may depend on them. Since the enabled/disabled state is part of the
+// ruleset, ScanTiered must not be called while other scans using the
+// same Rules object are in progress. The original state of all rules
+// is restored before ScanTiered returns.
+func (r *Rules) ScanTiered(buf []byte, tiers [][]string, flags ScanFlags, timeout time.Duration, cb ScanCallback) (err error) {
+	rules := r.GetRules()
+	defer r.restoreEnabled(rules)()
+	var allTags []string
+	for _, tier := range tiers {
+		allTags = append(allTags, tier...)
+	}
+	for _, tier := range tiers {
+		for i := range rules {
+			rule := &rules[i]
+			var selected bool
+			if len(tier) == 0 {
+				selected = !rule.hasAnyTag(allTags)
+			} else {
+				selected = rule.hasAnyTag(tier)
+			}
+			if selected || rule.IsGlobal() || rule.IsPrivate() {
+				rule.Enable()
+			} else {
+				rule.Disable()
+			}
+		}
+		cbc := makeScanCallbackContainer(cb, r)
+		if err = r.scanMem(buf, flags, timeout, cbc); err != nil || cbc.matching > 0 {
+			return
+		}
+	}
+	return
+}
+
+// ScanForRules scans an in-memory buffer using only the rules whose
+// identifiers are listed in ruleNames, returning their matches. A name
+// may be qualified with its namespace, as in "namespace:identifier".
+// An error is returned if a name does not refer to any rule.
+//
+// All other rules, except for global and private rules, are disabled
+// during the scan. As with ScanTiered, ScanForRules must not be called
+// while other scans using the same Rules object are in progress. The
+// original state of all rules is restored before ScanForRules
+// returns.
+func (r *Rules) ScanForRules(buf []byte, ruleNames []string, flags ScanFlags, timeout time.Duration) (MatchRules, error) {
+	names := make(map[string]bool)
+	for _, name := range ruleNames {
+		names[name] = false
+	}
+	rules := r.GetRules()
+	defer r.restoreEnabled(rules)()
+	for i := range rules {
+		rule := &rules[i]
+		var selected bool
+		for _, name := range []string{rule.Identifier(), rule.Namespace() + ":" + rule.Identifier()} {
+			if _, ok := names[name]; ok {
+				names[name] = true
+				selected = true
+			}
+		}
+		if selected || rule.IsGlobal() || rule.IsPrivate() {
+			rule.Enable()
+		} else {
+			rule.Disable()
+		}
+	}
+	for _, name := range ruleNames {
+		if !names[name] {
+			return nil, errors.New("rule not found: " + name)
+		}
+	}
+	var m MatchRules
+	if err := r.ScanMem(buf, flags, timeout, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// restoreEnabled records the enabled/disabled state of rules and
+// returns a function that restores it.
+func (r *Rules) restoreEnabled(rules []Rule) func() {
+	enabled := make([]bool, len(rules))
+	for i := range rules {
+		enabled[i] = rules[i].isEnabled()
+	}
+	return func() {
+		for i := range rules {
+			if enabled[i] {
+				rules[i].Enable()
+			} else {
+				rules[i].Disable()
+			}
+		}
+		runtime.KeepAlive(r)
+	}
+}
+
 // ScanFile scans a file using the ruleset. For every
 // event emitted by libyara, the corresponding method on the
 // ScanCallback object is called.
+//
+// The file is opened and memory-mapped by libyara, so its contents
+// are not copied into Go memory; this is preferable to reading the
+// file and passing it to ScanMem, especially for large files.
 func (r *Rules) ScanFile(filename string, flags ScanFlags, timeout time.Duration, cb ScanCallback) (err error) {
+	if r.cptr == nil {
+		return ErrRulesReleased
+	}
+	if err = checkScanCallback(cb); err != nil {
+		return
+	}
+	if err = startScan(cb, &ScanContext{rules: r}); err != nil {
+		return
+	}
 	cfilename := C.CString(filename)
 	defer C.free(unsafe.Pointer(cfilename))
-	id := callbackData.Put(makeScanCallbackContainer(cb, r))
+	cbc := makeScanCallbackContainer(cb, r)
+	defer cbc.finalize()
+	id := callbackData.Put(cbc)
 	defer callbackData.Delete(id)
 	err = newError(C.yr_rules_scan_file(
 		r.cptr,
@@ -134,7 +427,18 @@ func (r *Rules) ScanFile(filename string, flags ScanFlags, timeout time.Duration
 // emitted by libyara, the corresponding method on the ScanCallback
 // object is called.
 func (r *Rules) ScanFileDescriptor(fd uintptr, flags ScanFlags, timeout time.Duration, cb ScanCallback) (err error) {
-	id := callbackData.Put(makeScanCallbackContainer(cb, r))
+	if r.cptr == nil {
+		return ErrRulesReleased
+	}
+	if err = checkScanCallback(cb); err != nil {
+		return
+	}
+	if err = startScan(cb, &ScanContext{rules: r}); err != nil {
+		return
+	}
+	cbc := makeScanCallbackContainer(cb, r)
+	defer cbc.finalize()
+	id := callbackData.Put(cbc)
 	defer callbackData.Delete(id)
 	err = newError(C._yr_rules_scan_fd(
 		r.cptr,
@@ -147,11 +451,32 @@ func (r *Rules) ScanFileDescriptor(fd uintptr, flags ScanFlags, timeout time.Dur
 	return
 }
 
+// ScanOSFile scans an opened file using the ruleset. The file's
+// descriptor (or handle, on Windows) is passed to libyara; the file is
+// not closed. For every event emitted by libyara, the corresponding
+// method on the ScanCallback object is called.
+func (r *Rules) ScanOSFile(f *os.File, flags ScanFlags, timeout time.Duration, cb ScanCallback) (err error) {
+	err = r.ScanFileDescriptor(f.Fd(), flags, timeout, cb)
+	runtime.KeepAlive(f)
+	return
+}
+
 // ScanProc scans a live process using the ruleset.  For
 // every event emitted by libyara, the corresponding method on the
 // ScanCallback object is called.
 func (r *Rules) ScanProc(pid int, flags ScanFlags, timeout time.Duration, cb ScanCallback) (err error) {
-	id := callbackData.Put(makeScanCallbackContainer(cb, r))
+	if r.cptr == nil {
+		return ErrRulesReleased
+	}
+	if err = checkScanCallback(cb); err != nil {
+		return
+	}
+	if err = startScan(cb, &ScanContext{rules: r}); err != nil {
+		return
+	}
+	cbc := makeScanCallbackContainer(cb, r)
+	defer cbc.finalize()
+	id := callbackData.Put(cbc)
 	defer callbackData.Delete(id)
 	err = newError(C.yr_rules_scan_proc(
 		r.cptr,
@@ -168,11 +493,23 @@ func (r *Rules) ScanProc(pid int, flags ScanFlags, timeout time.Duration, cb Sca
 // For every event emitted by libyara, the corresponding method on the
 // ScanCallback object is called.
 func (r *Rules) ScanMemBlocks(mbi MemoryBlockIterator, flags ScanFlags, timeout time.Duration, cb ScanCallback) (err error) {
+	if r.cptr == nil {
+		return ErrRulesReleased
+	}
+	if err = checkScanCallback(cb); err != nil {
+		return
+	}
+	if err = startScan(cb, &ScanContext{rules: r}); err != nil {
+		return
+	}
 	c := makeMemoryBlockIteratorContainer(mbi)
 	defer c.free()
+	c.setBlockCallback(cb, &ScanContext{rules: r})
 	cmbi := makeCMemoryBlockIterator(c)
 	defer callbackData.Delete(cmbi.context)
-	id := callbackData.Put(makeScanCallbackContainer(cb, r))
+	cbc := makeScanCallbackContainer(cb, r)
+	defer cbc.finalize()
+	id := callbackData.Put(cbc)
 	defer callbackData.Delete(id)
 	err = newError(C.yr_rules_scan_mem_blocks(
 		r.cptr,
@@ -185,6 +522,25 @@ func (r *Rules) ScanMemBlocks(mbi MemoryBlockIterator, flags ScanFlags, timeout
 	return
 }
 
+// ScanRangeReader scans size bytes that are read from ra using the
+// ruleset. The data is read in blocks of RangeReaderBlockSize bytes,
+// so that only one block needs to be held in memory at a time. For
+// every event emitted by libyara, the corresponding method on the
+// ScanCallback object is called.
+//
+// libyara searches every block for strings, so all of the data is
+// read unless the ruleset contains no strings; modules such as pe
+// only parse the first block. Strings that cross a block boundary are
+// not found. If ReadAt fails, the scan is completed using the data
+// that could be read and the first error is returned.
+func (r *Rules) ScanRangeReader(ra io.ReaderAt, size int64, flags ScanFlags, timeout time.Duration, cb ScanCallback) error {
+	it := &readerAtIterator{ra: ra, size: size, blockSize: RangeReaderBlockSize}
+	if err := r.ScanMemBlocks(it, flags, timeout, cb); err != nil {
+		return err
+	}
+	return it.err
+}
+
 // Save writes a compiled ruleset to filename.
 func (r *Rules) Save(filename string) (err error) {
 	cfilename := C.CString(filename)
@@ -242,6 +598,162 @@ func ReadRules(rd io.Reader) (*Rules, error) {
 	return r, nil
 }
 
+// LoadRulesFromBytes retrieves a compiled ruleset from b, e.g. a
+// ruleset that has been embedded into the program. If the ruleset has
+// been written by an incompatible version of YARA, the returned error
+// names the linked version and wraps the underlying Error.
+func LoadRulesFromBytes(b []byte) (*Rules, error) {
+	r, err := ReadRules(bytes.NewReader(b))
+	if err == Error(C.ERROR_UNSUPPORTED_FILE_VERSION) {
+		return nil, fmt.Errorf("compiled rules are not compatible with YARA %s: %w", Version(), err)
+	}
+	return r, err
+}
+
+// Clone returns an independent copy of the ruleset. It is created by
+// serializing and deserializing the ruleset, so destroying either
+// copy does not affect the other.
+func (r *Rules) Clone() (*Rules, error) {
+	if r.cptr == nil {
+		return nil, ErrRulesReleased
+	}
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		return nil, err
+	}
+	return ReadRules(&buf)
+}
+
+// RulesInfo contains the information that is stored in the header of
+// a compiled ruleset. Which fields are set depends on the version of
+// libyara.
+type RulesInfo struct {
+	// FormatVersion is the version of libyara's file format. It is
+	// changed whenever compiled rules become incompatible.
+	FormatVersion int
+	// MaxThreads is the YR_MAX_THREADS value that libyara was built
+	// with. It is part of the file format version since rules
+	// compiled with a different value cannot be loaded. It is only
+	// set for YARA 4.0.
+	MaxThreads int
+	// Size is the size of the ruleset's data, without the header. It
+	// is only set for YARA 4.0.
+	Size uint32
+	// NumBuffers is the number of arena buffers that the ruleset
+	// consists of. It is only set for YARA 4.1 and later.
+	NumBuffers int
+}
+
+// hostByteOrder is the byte order of the host, which libyara uses for
+// compiled rules.
+var hostByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// rulesHeaderLayout returns the size of the header of compiled rules
+// as written by the libyara version that the package has been built
+// with, and the offset of the format version within the header. ok is
+// false for unknown versions of libyara.
+func rulesHeaderLayout() (size, versionOffset int, ok bool) {
+	switch {
+	case C.YR_MAJOR_VERSION == 4 && C.YR_MINOR_VERSION == 0:
+		// YR_ARENA_FILE_HEADER: magic, uint32 size, uint32 version
+		return 12, 8, true
+	case C.YR_MAJOR_VERSION == 4:
+		// YR_ARENA_FILE_HEADER: magic, uint8 version, uint8 num_buffers
+		return 6, 4, true
+	}
+	return 0, 0, false
+}
+
+// ErrNotCompiledRules is returned by InspectRules if the data does not
+// start with the header of a compiled ruleset.
+var ErrNotCompiledRules = errors.New("not a compiled YARA ruleset")
+
+// InspectRules reads the header of a compiled ruleset, as written by
+// Save or Write, from rd without loading the ruleset. The remaining
+// data is not consumed.
+//
+// The header layout differs between versions of libyara; the layout
+// of the version that the package has been built with is used, and an
+// error is returned for versions whose layout is not known. The header
+// contains neither the version of the compiler nor the number of
+// rules. libyara writes the header in the host's byte order, so it is
+// decoded in the host's byte order.
+func InspectRules(rd io.Reader) (info RulesInfo, err error) {
+	size, versionOffset, ok := rulesHeaderLayout()
+	if !ok {
+		return info, fmt.Errorf("header layout of compiled rules for YARA %s is not known", Version())
+	}
+	hdr := make([]byte, size)
+	if _, err = io.ReadFull(rd, hdr); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return info, ErrNotCompiledRules
+	} else if err != nil {
+		return
+	}
+	if string(hdr[:4]) != "YARA" {
+		return info, ErrNotCompiledRules
+	}
+	if size == 12 {
+		version := hostByteOrder.Uint32(hdr[versionOffset:])
+		info.Size = hostByteOrder.Uint32(hdr[4:])
+		info.FormatVersion = int(version >> 16)
+		info.MaxThreads = int(version & 0xffff)
+	} else {
+		info.FormatVersion = int(hdr[versionOffset])
+		info.NumBuffers = int(hdr[versionOffset+1])
+	}
+	return
+}
+
+// WriteAll writes several compiled rulesets to an io.Writer. Each
+// ruleset is prefixed with its length as a 64-bit big-endian
+// integer, so the rulesets can be read back individually using
+// ReadAll.
+func WriteAll(w io.Writer, rules []*Rules) error {
+	for _, r := range rules {
+		var buf bytes.Buffer
+		if err := r.Write(&buf); err != nil {
+			return err
+		}
+		var hdr [8]byte
+		binary.BigEndian.PutUint64(hdr[:], uint64(buf.Len()))
+		if _, err := writeFull(w, hdr[:]); err != nil {
+			return err
+		}
+		if _, err := writeFull(w, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadAll retrieves all compiled rulesets that have been written to
+// an io.Reader using WriteAll.
+func ReadAll(rd io.Reader) (rules []*Rules, err error) {
+	for {
+		var hdr [8]byte
+		if _, err = io.ReadFull(rd, hdr[:]); err == io.EOF {
+			return rules, nil
+		} else if err != nil {
+			return nil, err
+		}
+		lr := &io.LimitedReader{R: rd, N: int64(binary.BigEndian.Uint64(hdr[:]))}
+		var r *Rules
+		if r, err = ReadRules(lr); err != nil {
+			return nil, err
+		}
+		if _, err = io.Copy(ioutil.Discard, lr); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+}
+
 // Destroy destroys the YARA data structure representing a ruleset.
 //
 // It should not be necessary to call this method directly.
@@ -254,7 +766,9 @@ func (r *Rules) Destroy() {
 }
 
 // DefineVariable defines a named variable for use by the compiler.
-// Boolean, int64, float64, and string types are supported.
+// Boolean, int64, float64, and string types are supported. A
+// time.Time value is defined as an integer variable containing the
+// number of seconds since the Unix epoch.
 func (r *Rules) DefineVariable(identifier string, value interface{}) (err error) {
 	cid := C.CString(identifier)
 	defer C.free(unsafe.Pointer(cid))
@@ -267,9 +781,15 @@ func (r *Rules) DefineVariable(identifier string, value interface{}) (err error)
 		err = newError(C.yr_rules_define_boolean_variable(
 			r.cptr, cid, C.int(v)))
 	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
-		value := toint64(value)
+		var i int64
+		if i, err = toint64(value); err != nil {
+			break
+		}
+		err = newError(C.yr_rules_define_integer_variable(
+			r.cptr, cid, C.int64_t(i)))
+	case time.Time:
 		err = newError(C.yr_rules_define_integer_variable(
-			r.cptr, cid, C.int64_t(value)))
+			r.cptr, cid, C.int64_t(value.(time.Time).Unix())))
 	case float64:
 		err = newError(C.yr_rules_define_float_variable(
 			r.cptr, cid, C.double(value.(float64))))
@@ -279,7 +799,7 @@ func (r *Rules) DefineVariable(identifier string, value interface{}) (err error)
 		err = newError(C.yr_rules_define_string_variable(
 			r.cptr, cid, cvalue))
 	default:
-		err = errors.New("wrong value type passed to DefineVariable; bool, int64, float64, string are accepted")
+		err = errors.New("wrong value type passed to DefineVariable; bool, int64, float64, string, time.Time are accepted")
 	}
 	runtime.KeepAlive(r)
 	return
@@ -8,12 +8,92 @@ package yara
 
 /*
 #include <stdlib.h>
+#include <string.h>
 #include <yara.h>
+
+#ifndef CALLBACK_MSG_TOO_MANY_MATCHES
+// CALLBACK_MSG_TOO_MANY_MATCHES has been introduced in YARA 4.1. Older
+// versions fail the scan with ERROR_TOO_MANY_MATCHES instead.
+#define CALLBACK_MSG_TOO_MANY_MATCHES 6
+#endif
+
+// scan_context_object looks up an object (such as a module's root
+// structure) in the scan context's objects table.
+static YR_OBJECT* scan_context_object(YR_SCAN_CONTEXT* ctx, const char* name) {
+	return (YR_OBJECT*)yr_hash_table_lookup(ctx->objects_table, name, NULL);
+}
+
+// scan_context_modules returns pointers to the root objects of the
+// modules that have been imported during the scan. (Other objects
+// in the objects table represent external variables.)
+static void scan_context_modules(YR_SCAN_CONTEXT* ctx, YR_OBJECT* objects[], int* n) {
+	YR_HASH_TABLE* table = ctx->objects_table;
+	YR_HASH_TABLE_ENTRY* e;
+	YR_OBJECT* o;
+	int b, i = 0;
+	for (b = 0; table != NULL && b < table->size; b++) {
+		for (e = table->buckets[b]; e != NULL; e = e->next) {
+			o = (YR_OBJECT*)e->value;
+			if (o == NULL || o->type != OBJECT_TYPE_STRUCTURE)
+				continue;
+			if (i < *n)
+				objects[i] = o;
+			i++;
+		}
+	}
+	*n = i;
+	return;
+}
+
+// object_float is a union accessor function.
+static double object_float(YR_OBJECT* o) {
+	return o->value.d;
+}
+
+// scan_context_read_at copies the scanned data in the range
+// [off, off+len) into buf, walking the scan's memory blocks in the
+// same way as the uintXX functions do. It returns the number of bytes
+// that could be copied contiguously, starting at off.
+static size_t scan_context_read_at(YR_SCAN_CONTEXT* ctx, uint8_t* buf, size_t len, uint64_t off) {
+	YR_MEMORY_BLOCK* block;
+	const uint8_t* data;
+	uint64_t start, end;
+	size_t n = 0;
+	if (ctx->iterator == NULL)
+		return 0;
+	for (block = ctx->iterator->first(ctx->iterator);
+	     block != NULL && n < len;
+	     block = ctx->iterator->next(ctx->iterator)) {
+		start = off + n;
+		end = off + len;
+		if (start < block->base || start >= block->base + block->size)
+			continue;
+		if (end > block->base + block->size)
+			end = block->base + block->size;
+		data = block->fetch_data(block);
+		if (data == NULL)
+			break;
+		memcpy(buf + n, data + (start - block->base), end - start);
+		n += end - start;
+	}
+	return n;
+}
+
+// scan_context_rule_matching returns 1 if the rule's condition is
+// satisfied and the global rules of its namespace are satisfied as
+// well.
+static int scan_context_rule_matching(YR_SCAN_CONTEXT* ctx, YR_RULE* r) {
+	return yr_bitmask_is_set(ctx->rule_matches_flags, r - ctx->rules->rules_list_head) &&
+		!yr_bitmask_is_set(ctx->ns_unsatisfied_flags, r->ns->idx);
+}
 */
 import "C"
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
 	"reflect"
-	"runtime"
 	"unsafe"
 )
 
@@ -22,7 +102,151 @@ import (
 // Since this type contains a C pointer to a YR_SCAN_CONTEXT structure
 // that may be automatically freed, it should not be copied.
 type ScanContext struct {
-	cptr *C.YR_SCAN_CONTEXT
+	cptr  *C.YR_SCAN_CONTEXT
+	rules *Rules
+	// noData is set for contexts that are passed outside of libyara's
+	// callback messages, e.g. to ScanStarting. Only the scan's flags
+	// and external variables are available from them; the scan data,
+	// matches, and modules may belong to a previous scan.
+	noData bool
+}
+
+// hasData returns true if the scan's data, matches, and modules can
+// be accessed through sc.
+func (sc *ScanContext) hasData() bool {
+	return sc != nil && sc.cptr != nil && !sc.noData
+}
+
+// Flags returns the flags that are in effect for the current scan.
+func (sc *ScanContext) Flags() ScanFlags {
+	if sc.cptr == nil {
+		return 0
+	}
+	return ScanFlags(sc.cptr.flags)
+}
+
+// ReadAt reads len(p) bytes of the scanned data, starting at offset
+// off, into p. For process and memory block scans, off is an address
+// as reported by MatchString.Base. If fewer than len(p) bytes are
+// available at off, io.EOF is returned along with the number of bytes
+// that have been read.
+//
+// ReadAt implements io.ReaderAt; it can only be used while the scan
+// is in progress, i.e. from within callback methods. For
+// ScanMemBlocks, every call restarts the scan's MemoryBlockIterator
+// using First and walks it until the range has been read, fetching
+// the data of the blocks involved. The iterator must therefore be
+// able to restart and return the same blocks again.
+func (sc *ScanContext) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !sc.hasData() {
+		return 0, io.EOF
+	}
+	n = int(C.scan_context_read_at(sc.cptr, (*C.uint8_t)(unsafe.Pointer(&p[0])), C.size_t(len(p)), C.uint64_t(off)))
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+// Module returns the root object of the named module that has been
+// imported during the current scan. It can be used in all callback
+// methods after the module has been loaded, including ScanFinished.
+func (sc *ScanContext) Module(name string) (*Object, bool) {
+	if !sc.hasData() || sc.cptr.objects_table == nil {
+		return nil, false
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	ptr := C.scan_context_object(sc.cptr, cname)
+	if ptr == nil || ptr._type != C.OBJECT_TYPE_STRUCTURE {
+		return nil, false
+	}
+	return &Object{ptr}, true
+}
+
+// Modules returns the root objects of all modules that have been
+// imported during the current scan, keyed by module name. Like
+// Module, it can be used in all callback methods after the modules
+// have been loaded, including ScanFinished.
+func (sc *ScanContext) Modules() map[string]*Object {
+	modules := make(map[string]*Object)
+	if !sc.hasData() {
+		return modules
+	}
+	var size C.int
+	C.scan_context_modules(sc.cptr, nil, &size)
+	if size == 0 {
+		return modules
+	}
+	ptrs := make([]*C.YR_OBJECT, int(size))
+	C.scan_context_modules(sc.cptr, &ptrs[0], &size)
+	for _, ptr := range ptrs {
+		o := &Object{ptr}
+		modules[o.Identifier()] = o
+	}
+	return modules
+}
+
+// GetVariable returns the value of the named external variable that
+// is in effect for the current scan. Integer variables are returned
+// as int64, float variables as float64, and string variables as
+// string. Since libyara stores boolean variables as integers, they
+// are returned as int64 values 0 or 1.
+func (sc *ScanContext) GetVariable(name string) (interface{}, bool) {
+	if sc == nil || sc.cptr == nil || sc.cptr.objects_table == nil {
+		return nil, false
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	ptr := C.scan_context_object(sc.cptr, cname)
+	if ptr == nil {
+		return nil, false
+	}
+	o := &Object{ptr}
+	switch ptr._type {
+	case C.OBJECT_TYPE_INTEGER:
+		return o.Integer()
+	case C.OBJECT_TYPE_FLOAT:
+		return float64(C.object_float(ptr)), true
+	case C.OBJECT_TYPE_STRING:
+		return o.StringValue()
+	}
+	return nil, false
+}
+
+// MatchingRules returns all rules that match during the current
+// scan, including private rules that are not reported through
+// RuleMatching. Since libyara evaluates all conditions before it
+// reports any results, MatchingRules can be used in all callback
+// methods.
+func (sc *ScanContext) MatchingRules() (rules []*Rule) {
+	if !sc.hasData() || sc.rules == nil {
+		return
+	}
+	for _, r := range sc.rules.GetRules() {
+		if C.scan_context_rule_matching(sc.cptr, r.cptr) != 0 {
+			rule := r
+			rules = append(rules, &rule)
+		}
+	}
+	return
+}
+
+// MatchedStrings returns the string matches of all rules that match
+// during the current scan, in the order of MatchingRules. Like
+// MatchingRules, it includes private rules and can be used in all
+// callback methods, including ScanFinished.
+func (sc *ScanContext) MatchedStrings() (matches []MatchString) {
+	for _, r := range sc.MatchingRules() {
+		matches = append(matches, r.getMatchStrings(sc, nil)...)
+	}
+	return
 }
 
 // ScanCallback is a placeholder for different interfaces that may be
@@ -31,13 +255,60 @@ type ScanContext struct {
 //
 // The RuleMatching method corresponds to YARA's
 // CALLBACK_MSG_RULE_MATCHING message.
+//
+// A nil ScanCallback may be passed if only the scan's side effects
+// are of interest. A nil pointer, such as a nil *MatchRules, is
+// rejected with ErrNilCallback.
 type ScanCallback interface {
 	RuleMatching(*ScanContext, *Rule) (bool, error)
 }
 
+// checkScanCallback returns ErrNilCallback if cb holds a nil pointer,
+// such as a nil *MatchRules. A nil ScanCallback interface value is
+// allowed; the scan is then run without a callback.
+func checkScanCallback(cb ScanCallback) error {
+	if cb == nil {
+		return nil
+	}
+	if v := reflect.ValueOf(cb); v.Kind() == reflect.Ptr && v.IsNil() {
+		return ErrNilCallback
+	}
+	return nil
+}
+
+// ScanCallbackStart is used to set up per-scan state. libyara has no
+// message for the start of a scan, so ScanStarting is called by the
+// ScanXxx methods just before they call into libyara, i.e. before
+// any module is imported and before any condition is evaluated. If
+// ScanStarting returns an error, the scan is not started and the
+// error is returned.
+//
+// The scan has not started yet, so the methods of the ScanContext
+// that access scan data, matches, or modules (ReadAt, Module,
+// Modules, MatchingRules, MatchedStrings, and String.Matches) return
+// zero values. (*Scanner).ScanXxx methods pass a ScanContext through
+// which the scanner's flags and external variables are available.
+// The (*Rules).ScanXxx methods cannot do that since libyara only
+// creates the scan context once the scan has started, so Flags and
+// GetVariable return zero values as well.
+type ScanCallbackStart interface {
+	ScanStarting(ctx *ScanContext) error
+}
+
+// startScan calls ScanStarting if cb implements ScanCallbackStart.
+func startScan(cb ScanCallback, sc *ScanContext) error {
+	if c, ok := cb.(ScanCallbackStart); ok {
+		return c.ScanStarting(sc)
+	}
+	return nil
+}
+
 // ScanCallbackNoMatch is used to record rules that did not match
 // during a scan. The RuleNotMatching method corresponds to YARA's
 // CALLBACK_MSG_RULE_NOT_MATCHING mssage.
+//
+// Within RuleNotMatching, (*Rule).UnmatchedStrings can be used to
+// find out which of the rule's strings have not been found.
 type ScanCallbackNoMatch interface {
 	RuleNotMatching(*ScanContext, *Rule) (bool, error)
 }
@@ -52,6 +323,17 @@ type ScanCallbackFinished interface {
 // ScanCallbackModuleImport is used to provide data to a YARA module.
 // The ImportModule method corresponds to YARA's
 // CALLBACK_MSG_IMPORT_MODULE message.
+//
+// libyara loads modules in the order in which their import
+// statements first appear in the compiled rule sources, so the order
+// of ImportModule calls is stable for a given ruleset. Modules that
+// are imported by several rule files are only loaded once.
+//
+// Time spent in ImportModule and in the module itself counts towards
+// the scan's timeout. libyara cannot interrupt a running callback or
+// module, but it checks the timeout once they have returned, so a
+// scan whose module data takes too long to produce fails with
+// ErrScanTimeout.
 type ScanCallbackModuleImport interface {
 	ImportModule(*ScanContext, string) ([]byte, bool, error)
 }
@@ -64,6 +346,79 @@ type ScanCallbackModuleImportFinished interface {
 	ModuleImported(*ScanContext, *Object) (bool, error)
 }
 
+// ScanCallbackTooManyMatches is used to decide what happens if a
+// string has exceeded the maximum number of matches that libyara
+// records. The TooManyMatches method corresponds to YARA's
+// CALLBACK_MSG_TOO_MANY_MATCHES message, which has been introduced in
+// YARA 4.1.
+//
+// If TooManyMatches returns neither an error nor abort, the scan
+// continues and further matches for the string are dropped. If the
+// callback object does not implement ScanCallbackTooManyMatches, the
+// scan fails with ErrTooManyMatches, as it does with older versions
+// of YARA.
+type ScanCallbackTooManyMatches interface {
+	TooManyMatches(*ScanContext, *String) (bool, error)
+}
+
+// ScanCallbackBlock is used to collect the memory blocks that are
+// scanned, e.g. for throughput metrics. libyara has no message for
+// individual blocks, so BlockScanned is called by the ScanMemBlocks
+// methods (and ScanRangeReader) whenever libyara takes the next block
+// from the MemoryBlockIterator while it searches the blocks for
+// strings, with the block's base address and size. Later walks over
+// the blocks, e.g. by modules, are not reported. The ScanMem methods
+// report their buffer as a single block at base 0 before the scan
+// starts. ScanFile, ScanFileDescriptor, and ScanProc use libyara's
+// own iterators and report no blocks.
+//
+// As in ScanStarting, the methods of the ScanContext that access
+// scan data, matches, or modules return zero values.
+type ScanCallbackBlock interface {
+	BlockScanned(ctx *ScanContext, base int64, size int)
+}
+
+// blockScanned returns a function that passes block events to cb, or
+// to the callback objects of a MultiCallback that implement
+// ScanCallbackBlock. If there are none, nil is returned, so that
+// MultiCallback objects do not cause block events to be generated
+// needlessly.
+func blockScanned(cb ScanCallback) func(*ScanContext, int64, int) {
+	switch c := cb.(type) {
+	case ScanCallbackBlock:
+		return c.BlockScanned
+	case MultiCallback:
+		var fs []func(*ScanContext, int64, int)
+		for _, c := range c {
+			if f := blockScanned(c); f != nil {
+				fs = append(fs, f)
+			}
+		}
+		if len(fs) == 0 {
+			return nil
+		}
+		return func(sc *ScanContext, base int64, size int) {
+			for _, f := range fs {
+				f(sc, base, size)
+			}
+		}
+	}
+	return nil
+}
+
+// ScanCallbackRaw receives callback messages that are not handled by
+// any of the other ScanCallbackXxx interfaces, such as messages that
+// are introduced by YARA versions newer than this package. message is
+// one of libyara's CALLBACK_MSG_* values and data is the message_data
+// pointer passed by libyara.
+//
+// This is inherently unsafe: The type and lifetime of the object
+// that data points to depend on the message and on the libyara
+// version; data must not be used after OnMessage has returned.
+type ScanCallbackRaw interface {
+	OnMessage(ctx *ScanContext, message int, data unsafe.Pointer) (bool, error)
+}
+
 // scanCallbackContainer is used by to pass a ScanCallback (and
 // associated data) between ScanXxx methods and scanCallbackFunc(). It
 // stores the public callback interface and a list of malloc()'d C
@@ -72,37 +427,49 @@ type scanCallbackContainer struct {
 	ScanCallback
 	rules *Rules
 	cdata []unsafe.Pointer
+	// matching counts CALLBACK_MSG_RULE_MATCHING messages.
+	matching int
+	// messages counts all messages.
+	messages int
 }
 
-// makeScanCallbackContainer sets up a scanCallbackContainer with a
-// finalizer method that that frees any stored C pointers when the
-// container is garbage-collected.
+// makeScanCallbackContainer sets up a scanCallbackContainer. The
+// caller is responsible for calling finalize once the scan has
+// finished. (A finalizer is not used since it would have to be set
+// and cleared for every scan.)
 func makeScanCallbackContainer(sc ScanCallback, r *Rules) *scanCallbackContainer {
-	c := &scanCallbackContainer{sc, r, nil}
-	runtime.SetFinalizer(c, (*scanCallbackContainer).finalize)
-	return c
+	return &scanCallbackContainer{ScanCallback: sc, rules: r}
 }
 
 // addCPointer adds a C pointer that can later be freed using free().
 func (c *scanCallbackContainer) addCPointer(p unsafe.Pointer) { c.cdata = append(c.cdata, p) }
 
-// finalize frees stored C pointers
+// finalize frees stored C pointers. It is called once the scan has
+// finished.
 func (c *scanCallbackContainer) finalize() {
 	for _, p := range c.cdata {
 		C.free(p)
 	}
 	c.cdata = nil
-	runtime.SetFinalizer(c, nil)
 }
 
 //export scanCallbackFunc
 func scanCallbackFunc(ctx *C.YR_SCAN_CONTEXT, message C.int, messageData, userData unsafe.Pointer) C.int {
-	cbc, ok := callbackData.Get(userData).(*scanCallbackContainer)
-	s := &ScanContext{cptr: ctx}
+	data := callbackData.Get(userData)
+	cbc, ok := data.(*scanCallbackContainer)
 	if !ok {
+		logf("scan callback: expected *scanCallbackContainer, found %T", data)
 		return C.CALLBACK_ERROR
 	}
-	if cbc.ScanCallback == nil {
+	s := &ScanContext{cptr: ctx, rules: cbc.rules}
+	cbc.messages++
+	switch message {
+	case C.CALLBACK_MSG_RULE_MATCHING:
+		cbc.matching++
+	case C.CALLBACK_MSG_SCAN_FINISHED:
+		logf("scan callback: scan finished after %d messages, %d matching rules", cbc.messages, cbc.matching)
+	}
+	if cbc.ScanCallback == nil && message != C.CALLBACK_MSG_TOO_MANY_MATCHES {
 		return C.CALLBACK_CONTINUE
 	}
 	var abort bool
@@ -137,9 +504,20 @@ func scanCallbackFunc(ctx *C.YR_SCAN_CONTEXT, message C.int, messageData, userDa
 		if c, ok := cbc.ScanCallback.(ScanCallbackModuleImportFinished); ok {
 			abort, err = c.ModuleImported(s, &Object{(*C.YR_OBJECT)(messageData)})
 		}
+	case C.CALLBACK_MSG_TOO_MANY_MATCHES:
+		c, ok := cbc.ScanCallback.(ScanCallbackTooManyMatches)
+		if !ok {
+			return C.CALLBACK_ERROR
+		}
+		abort, err = c.TooManyMatches(s, &String{cptr: (*C.YR_STRING)(messageData), rules: cbc.rules})
+	default:
+		if c, ok := cbc.ScanCallback.(ScanCallbackRaw); ok {
+			abort, err = c.OnMessage(s, int(message), messageData)
+		}
 	}
 
 	if err != nil {
+		logf("scan callback: message %d: %v", message, err)
 		return C.CALLBACK_ERROR
 	}
 	if abort {
@@ -155,12 +533,341 @@ type MatchRules []MatchRule
 // RuleMatching implements the ScanCallbackMatch interface for
 // MatchRules.
 func (mr *MatchRules) RuleMatching(sc *ScanContext, r *Rule) (abort bool, err error) {
-	*mr = append(*mr, MatchRule{
-		Rule:      r.Identifier(),
-		Namespace: r.Namespace(),
-		Tags:      r.Tags(),
-		Metas:     r.Metas(),
-		Strings:   r.getMatchStrings(sc),
+	return mr.Collector().RuleMatching(sc, r)
+}
+
+// A MatchCollector collects matching rules into a MatchRules object,
+// just like a *MatchRules used as ScanCallback. Its behavior can be
+// tuned using the SetXxx methods.
+type MatchCollector struct {
+	matches *MatchRules
+	alloc   func(n int) []byte
+	source  string
+	tags    map[string]bool
+	context int
+	// hash is computed for the first matching rule of a scan and
+	// reset by ScanStarting.
+	hashData bool
+	hash     string
+}
+
+// Collector returns a MatchCollector that appends to mr.
+func (mr *MatchRules) Collector() *MatchCollector {
+	return &MatchCollector{matches: mr}
+}
+
+// SetAllocator sets a function that is used to allocate the buffers
+// that hold the data of matched strings (MatchString.Data). The
+// function should return a slice of length n; longer slices are
+// truncated to n bytes, and shorter ones receive only the first
+// len(slice) bytes of the data. This can be used to back
+// match data with a pool or an arena in order to reduce GC pressure.
+// By default, buffers are allocated using make.
+func (c *MatchCollector) SetAllocator(alloc func(n int) []byte) *MatchCollector {
+	c.alloc = alloc
+	return c
+}
+
+// SetSource sets the name that is stored in the Source field of every
+// collected MatchRule.
+func (c *MatchCollector) SetSource(name string) *MatchCollector {
+	c.source = name
+	return c
+}
+
+// SetContextBytes makes the collector store up to n bytes before and
+// after each matched string in MatchString.Context, in addition to
+// the match itself. The data is read using ScanContext.ReadAt, so for
+// ScanMemBlocks, the iterator is restarted for every matched string.
+func (c *MatchCollector) SetContextBytes(n int) *MatchCollector {
+	c.context = n
+	return c
+}
+
+// readContext fills in the context window of ms. The window does not
+// extend beyond the start of the memory block that contains the match.
+func (c *MatchCollector) readContext(sc *ScanContext, ms *MatchString) {
+	pos := int64(ms.Base + ms.Offset)
+	start := pos - int64(c.context)
+	if start < int64(ms.Base) {
+		start = int64(ms.Base)
+	}
+	buf := make([]byte, int(pos-start)+ms.Length+c.context)
+	n, _ := sc.ReadAt(buf, start)
+	ms.Context, ms.ContextOffset = buf[:n], int(pos-start)
+}
+
+// SetDataHash makes the collector store the hex-encoded SHA-256 hash
+// of the scanned data in the DataHash field of every collected
+// MatchRule. The hash is only computed if at least one rule matches.
+// The data is read using ScanContext.ReadAt, starting at offset 0 and
+// up to the scan's filesize, so this is only useful for buffers and
+// files (not for memory blocks or processes).
+func (c *MatchCollector) SetDataHash(enabled bool) *MatchCollector {
+	c.hashData = enabled
+	return c
+}
+
+// dataHash computes the SHA-256 hash of the scanned data.
+func dataHash(sc *ScanContext) string {
+	h := sha256.New()
+	buf := make([]byte, 64*1024)
+	for off, size := int64(0), int64(sc.cptr.file_size); off < size; off += int64(len(buf)) {
+		if size-off < int64(len(buf)) {
+			buf = buf[:size-off]
+		}
+		n, _ := sc.ReadAt(buf, off)
+		h.Write(buf[:n])
+		if n < len(buf) {
+			break
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ScanStarting implements the ScanCallbackStart interface for
+// MatchCollector. The hash is reset here rather than at the end of a
+// scan because libyara does not report the end of aborted scans.
+func (c *MatchCollector) ScanStarting(*ScanContext) error {
+	c.hash = ""
+	return nil
+}
+
+// SetTagFilter restricts collection to rules that carry at least one
+// of the given tags. Other matching rules are skipped before any of
+// their data is copied. Passing an empty list removes the filter.
+func (c *MatchCollector) SetTagFilter(tags []string) *MatchCollector {
+	c.tags = nil
+	if len(tags) > 0 {
+		c.tags = make(map[string]bool, len(tags))
+		for _, tag := range tags {
+			c.tags[tag] = true
+		}
+	}
+	return c
+}
+
+// hasTag reports whether r is collected according to the tag filter.
+func (c *MatchCollector) hasTag(r *Rule) bool {
+	if c.tags == nil {
+		return true
+	}
+	for _, tag := range r.Tags() {
+		if c.tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleMatching implements the ScanCallbackMatch interface for
+// MatchCollector.
+func (c *MatchCollector) RuleMatching(sc *ScanContext, r *Rule) (abort bool, err error) {
+	if !c.hasTag(r) {
+		return
+	}
+	strs := r.getMatchStrings(sc, c.alloc)
+	if c.context > 0 {
+		for i := range strs {
+			c.readContext(sc, &strs[i])
+		}
+	}
+	if c.hashData && c.hash == "" {
+		c.hash = dataHash(sc)
+	}
+	var counts map[string]int
+	if len(strs) > 0 {
+		counts = make(map[string]int)
+		for _, ms := range strs {
+			counts[ms.Name]++
+		}
+	}
+	*c.matches = append(*c.matches, MatchRule{
+		Rule:              r.Identifier(),
+		Namespace:         r.Namespace(),
+		Tags:              r.Tags(),
+		Metas:             r.Metas(),
+		Strings:           strs,
+		StringMatchCounts: counts,
+		FastMode:          sc.Flags()&ScanFlagsFastMode != 0,
+		Source:            c.source,
+		DataHash:          c.hash,
 	})
 	return
 }
+
+// MultiCallback dispatches every message to all of the contained
+// callback objects, in order, as far as they implement the
+// corresponding interface. It can be used, for example, to combine a
+// MatchRules collector with a logging callback.
+//
+// If any of the callback objects returns an error, the error is
+// returned immediately, without calling the callback objects that
+// follow. If any of them requests the scan to be aborted, the
+// remaining callback objects are still called, then the scan is
+// aborted.
+//
+// Since MultiCallback implements ScanCallbackNoMatch, libyara
+// always reports non-matching rules when it is used.
+type MultiCallback []ScanCallback
+
+// RuleMatching implements the ScanCallback interface.
+func (mc MultiCallback) RuleMatching(sc *ScanContext, r *Rule) (abort bool, err error) {
+	for _, c := range mc {
+		var a bool
+		if a, err = c.RuleMatching(sc, r); err != nil {
+			return
+		}
+		abort = abort || a
+	}
+	return
+}
+
+// RuleNotMatching implements the ScanCallbackNoMatch interface.
+func (mc MultiCallback) RuleNotMatching(sc *ScanContext, r *Rule) (abort bool, err error) {
+	for _, c := range mc {
+		if c, ok := c.(ScanCallbackNoMatch); ok {
+			var a bool
+			if a, err = c.RuleNotMatching(sc, r); err != nil {
+				return
+			}
+			abort = abort || a
+		}
+	}
+	return
+}
+
+// ScanFinished implements the ScanCallbackFinished interface.
+func (mc MultiCallback) ScanFinished(sc *ScanContext) (abort bool, err error) {
+	for _, c := range mc {
+		if c, ok := c.(ScanCallbackFinished); ok {
+			var a bool
+			if a, err = c.ScanFinished(sc); err != nil {
+				return
+			}
+			abort = abort || a
+		}
+	}
+	return
+}
+
+// ImportModule implements the ScanCallbackModuleImport interface.
+// The first non-empty module data returned by any of the callback
+// objects is passed to the module.
+func (mc MultiCallback) ImportModule(sc *ScanContext, name string) (data []byte, abort bool, err error) {
+	for _, c := range mc {
+		if c, ok := c.(ScanCallbackModuleImport); ok {
+			var buf []byte
+			var a bool
+			if buf, a, err = c.ImportModule(sc, name); err != nil {
+				return
+			}
+			if len(data) == 0 {
+				data = buf
+			}
+			abort = abort || a
+		}
+	}
+	return
+}
+
+// ModuleImported implements the ScanCallbackModuleImportFinished
+// interface.
+func (mc MultiCallback) ModuleImported(sc *ScanContext, obj *Object) (abort bool, err error) {
+	for _, c := range mc {
+		if c, ok := c.(ScanCallbackModuleImportFinished); ok {
+			var a bool
+			if a, err = c.ModuleImported(sc, obj); err != nil {
+				return
+			}
+			abort = abort || a
+		}
+	}
+	return
+}
+
+// TooManyMatches implements the ScanCallbackTooManyMatches interface.
+// If none of the callback objects implements it, ErrTooManyMatches is
+// returned.
+func (mc MultiCallback) TooManyMatches(sc *ScanContext, str *String) (abort bool, err error) {
+	implemented := false
+	for _, c := range mc {
+		if c, ok := c.(ScanCallbackTooManyMatches); ok {
+			implemented = true
+			var a bool
+			if a, err = c.TooManyMatches(sc, str); err != nil {
+				return
+			}
+			abort = abort || a
+		}
+	}
+	if !implemented {
+		err = ErrTooManyMatches
+	}
+	return
+}
+
+// OnMessage implements the ScanCallbackRaw interface.
+func (mc MultiCallback) OnMessage(sc *ScanContext, message int, data unsafe.Pointer) (abort bool, err error) {
+	for _, c := range mc {
+		if c, ok := c.(ScanCallbackRaw); ok {
+			var a bool
+			if a, err = c.OnMessage(sc, message, data); err != nil {
+				return
+			}
+			abort = abort || a
+		}
+	}
+	return
+}
+
+// ScanStarting implements the ScanCallbackStart interface.
+func (mc MultiCallback) ScanStarting(sc *ScanContext) error {
+	for _, c := range mc {
+		if err := startScan(c, sc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ModuleData maps module names to data that is passed to the modules
+// when they are imported. It implements ScanCallbackModuleImport and
+// can be combined with other callback objects using MultiCallback.
+type ModuleData map[string][]byte
+
+// RuleMatching implements the ScanCallback interface. It does
+// nothing.
+func (md ModuleData) RuleMatching(*ScanContext, *Rule) (bool, error) {
+	return false, nil
+}
+
+// ImportModule implements the ScanCallbackModuleImport interface.
+func (md ModuleData) ImportModule(_ *ScanContext, name string) ([]byte, bool, error) {
+	return md[name], false, nil
+}
+
+// Data implements the ModuleDataProvider interface.
+func (md ModuleData) Data(module string) ([]byte, error) {
+	return md[module], nil
+}
+
+// A ModuleDataProvider returns the data that is passed to a module
+// when it is imported. If Data returns no data, the module is loaded
+// without any. See (*Scanner).SetModuleDataProvider.
+type ModuleDataProvider interface {
+	Data(module string) ([]byte, error)
+}
+
+// moduleDataProviderCallback adapts a ModuleDataProvider to the
+// ScanCallbackModuleImport interface.
+type moduleDataProviderCallback struct{ ModuleDataProvider }
+
+func (c moduleDataProviderCallback) RuleMatching(*ScanContext, *Rule) (bool, error) {
+	return false, nil
+}
+
+func (c moduleDataProviderCallback) ImportModule(_ *ScanContext, name string) ([]byte, bool, error) {
+	buf, err := c.Data(name)
+	return buf, false, err
+}
@@ -9,13 +9,21 @@ package yara
 import (
 	"bytes"
 	"compress/bzip2"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"reflect"
 	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 func makeRules(t *testing.T, rule string) *Rules {
@@ -318,3 +326,1742 @@ func TestImportDataCallback(t *testing.T) {
 	}
 	runtime.GC()
 }
+
+func TestScanTiered(t *testing.T) {
+	r := makeRules(t, `
+		rule critical : critical { strings: $a = "abc" condition: $a }
+		rule normal : normal { strings: $a = "abc" condition: $a }
+		rule other { strings: $a = "abc" condition: $a }`)
+	tiers := [][]string{{"critical"}, {"normal"}, {}}
+	for _, tc := range []struct {
+		data     string
+		expected string
+	}{
+		{" abc ", "critical"},
+		{" xyz ", ""},
+	} {
+		var m MatchRules
+		if err := r.ScanTiered([]byte(tc.data), tiers, 0, 0, &m); err != nil {
+			t.Errorf("ScanTiered(%q): %s", tc.data, err)
+			continue
+		}
+		if tc.expected == "" {
+			if len(m) != 0 {
+				t.Errorf("ScanTiered(%q): expected no matches, got %+v", tc.data, m)
+			}
+		} else if len(m) != 1 || m[0].Rule != tc.expected {
+			t.Errorf("ScanTiered(%q): expected match for %s, got %+v", tc.data, tc.expected, m)
+		}
+	}
+	var m MatchRules
+	if err := r.ScanMem([]byte(" abc "), 0, 0, &m); err != nil {
+		t.Fatal(err)
+	} else if len(m) != 3 {
+		t.Errorf("rules were not re-enabled after ScanTiered: got %+v", m)
+	}
+}
+
+type unmatchedStringsCallback map[string][]string
+
+func (c unmatchedStringsCallback) RuleMatching(*ScanContext, *Rule) (bool, error) {
+	return false, nil
+}
+
+func (c unmatchedStringsCallback) RuleNotMatching(sc *ScanContext, r *Rule) (bool, error) {
+	for _, s := range r.UnmatchedStrings(sc) {
+		c[r.Identifier()] = append(c[r.Identifier()], s.Identifier())
+	}
+	return false, nil
+}
+
+func TestUnmatchedStrings(t *testing.T) {
+	r := makeRules(t, `
+		rule t1 { strings: $a = "abc" $b = "def" $c = "ghi" condition: all of them }`)
+	cb := make(unmatchedStringsCallback)
+	if err := r.ScanMem([]byte(" abc ghi "), 0, 0, cb); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"$b"}; !reflect.DeepEqual(cb["t1"], expected) {
+		t.Errorf("expected unmatched strings %v, got %v", expected, cb["t1"])
+	}
+}
+
+type testArena struct{ buf []byte }
+
+func (a *testArena) alloc(n int) []byte {
+	if len(a.buf)+n > cap(a.buf) {
+		a.buf = make([]byte, 0, 2*(cap(a.buf)+n))
+	}
+	start := len(a.buf)
+	a.buf = a.buf[:start+n]
+	return a.buf[start : start+n : start+n]
+}
+
+func (a *testArena) reset() { a.buf = a.buf[:0] }
+
+func TestMatchCollectorAllocator(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = "abc" condition: $a }`)
+	var a testArena
+	var m MatchRules
+	if err := r.ScanMem([]byte(" abc abc "), 0, 0, m.Collector().SetAllocator(a.alloc)); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || len(m[0].Strings) != 2 {
+		t.Fatalf("unexpected matches: %+v", m)
+	}
+	for _, ms := range m[0].Strings {
+		if string(ms.Data) != "abc" {
+			t.Errorf("unexpected match data %q", ms.Data)
+		}
+	}
+	if string(a.buf) != "abcabc" {
+		t.Errorf("match data was not allocated from arena: %q", a.buf)
+	}
+
+	// Allocators that return slices of the wrong length must not
+	// cause reads beyond the match data.
+	for _, extra := range []int{64, -1} {
+		m = nil
+		alloc := func(n int) []byte { return make([]byte, n+extra) }
+		if err := r.ScanMem([]byte(" abc "), 0, 0, m.Collector().SetAllocator(alloc)); err != nil {
+			t.Fatal(err)
+		}
+		expected := "abc"
+		if extra < 0 {
+			expected = "ab"
+		}
+		if len(m) != 1 || string(m[0].Strings[0].Data) != expected {
+			t.Errorf("extra=%d: expected data %q, got %+v", extra, expected, m)
+		}
+	}
+}
+
+func BenchmarkMatchCollectorAllocator(b *testing.B) {
+	r, err := Compile(`rule t { strings: $a = "abc" condition: $a }`, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := bytes.Repeat([]byte(" abc "), 1000)
+	b.Run("make", func(b *testing.B) {
+		b.ReportAllocs()
+		var m MatchRules
+		for i := 0; i < b.N; i++ {
+			m = m[:0]
+			if err := r.ScanMem(buf, 0, 0, &m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("arena", func(b *testing.B) {
+		b.ReportAllocs()
+		var m MatchRules
+		var a testArena
+		for i := 0; i < b.N; i++ {
+			m = m[:0]
+			a.reset()
+			if err := r.ScanMem(buf, 0, 0, m.Collector().SetAllocator(a.alloc)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestCountMatches(t *testing.T) {
+	r := makeRules(t, `
+rule a { condition: true }
+rule b { strings: $s = "abc" condition: $s }
+rule c { strings: $s = "xyz" condition: $s }`)
+	if n, err := r.CountMatches([]byte(" abc "), 0, 0); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Errorf("expected 2 matching rules, got %d", n)
+	}
+}
+
+func BenchmarkCountMatches(b *testing.B) {
+	r, err := Compile(`rule t { strings: $a = "abc" condition: $a }`, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := bytes.Repeat([]byte(" abc "), 1000)
+	b.Run("count", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := r.CountMatches(buf, 0, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("collect", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var m MatchRules
+			if err := r.ScanMem(buf, 0, 0, &m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkScanLargeFile(b *testing.B) {
+	r, err := Compile(`rule t { strings: $a = "abc" condition: $a }`, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "BenchmarkScanLargeFile")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(bytes.Repeat([]byte{0x90}, 64<<20)); err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+	b.Run("ScanFile", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var m MatchRules
+			if err := r.ScanFile(f.Name(), 0, 0, &m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ReadFile+ScanMem", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf, err := ioutil.ReadFile(f.Name())
+			if err != nil {
+				b.Fatal(err)
+			}
+			var m MatchRules
+			if err := r.ScanMem(buf, 0, 0, &m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestScanMemBufferTooLarge(t *testing.T) {
+	// On common platforms, size_t can represent any slice length,
+	// so the limit is lowered for testing.
+	defer func(limit uint64) { maxScanBufferSize = limit }(maxScanBufferSize)
+	maxScanBufferSize = 4
+	r := makeRules(t, `rule t { condition: true }`)
+	var m MatchRules
+	if err := r.ScanMem([]byte("abcd"), 0, 0, &m); err != nil {
+		t.Errorf("ScanMem at limit: %v", err)
+	}
+	if err := r.ScanMem([]byte("abcde"), 0, 0, &m); err != ErrBufferTooLarge {
+		t.Errorf("ScanMem beyond limit: expected ErrBufferTooLarge, got %v", err)
+	}
+	s, err := NewScanner(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ScanMem([]byte("abcde")); err != ErrBufferTooLarge {
+		t.Errorf("Scanner.ScanMem beyond limit: expected ErrBufferTooLarge, got %v", err)
+	}
+}
+
+func TestNamespaceCounts(t *testing.T) {
+	c, err := NewCompiler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddString(`rule a { condition: true } rule b { condition: true }`, "ns1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddString(`rule c { condition: true }`, "ns2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddString(`rule d { condition: true }`, ""); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{"ns1": 2, "ns2": 1, "default": 1}
+	if got := r.NamespaceCounts(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestScanFlagsNoTryCatch(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = "abc" condition: $a }`)
+	var m MatchRules
+	if err := r.ScanMem([]byte(" abc "), ScanFlagsNoTryCatch, 0, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Errorf("expected 1 match, got %d", len(m))
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	c, err := NewCompiler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []struct{ rule, ns string }{
+		{`rule a { condition: true }`, "zeta"},
+		{`rule b { condition: true }`, "alpha"},
+		{`rule c { condition: true }`, "zeta"},
+	} {
+		if err := c.AddString(src.rule, src.ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := c.GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"alpha", "zeta"}
+	if got := r.Namespaces(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err = ReadRules(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Namespaces(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("after ReadRules: expected %v, got %v", expected, got)
+	}
+}
+
+type moduleAtFinishCallback struct {
+	numberOfSections int64
+	found            bool
+}
+
+func (c *moduleAtFinishCallback) RuleMatching(*ScanContext, *Rule) (bool, error) {
+	return false, nil
+}
+
+func (c *moduleAtFinishCallback) ScanFinished(sc *ScanContext) (bool, error) {
+	if pe, ok := sc.Module("pe"); ok {
+		if o, ok := pe.Field("number_of_sections"); ok {
+			c.numberOfSections, c.found = o.Integer()
+		}
+	}
+	return false, nil
+}
+
+func TestScanContextModule(t *testing.T) {
+	r := makeRules(t, `import "pe" rule t { condition: pe.is_pe }`)
+	cb := &moduleAtFinishCallback{}
+	if err := r.ScanMem(pe32file, 0, 0, cb); err != nil {
+		t.Fatal(err)
+	}
+	if !cb.found {
+		t.Fatal("pe.number_of_sections not found at ScanFinished")
+	}
+	if cb.numberOfSections != 1 {
+		t.Errorf("expected pe.number_of_sections == 1, got %d", cb.numberOfSections)
+	}
+}
+
+type matchedStringsCallback struct {
+	MatchRules
+	strings []MatchString
+}
+
+func (c *matchedStringsCallback) ScanFinished(sc *ScanContext) (bool, error) {
+	c.strings = sc.MatchedStrings()
+	return false, nil
+}
+
+func TestScanContextMatchedStrings(t *testing.T) {
+	r := makeRules(t, `
+rule a { strings: $a = "foo" $b = "bar" condition: any of them }
+rule b { strings: $c = "foo" condition: $c }
+rule c { strings: $d = "baz" condition: $d }`)
+	cb := &matchedStringsCallback{}
+	if err := r.ScanMem([]byte("foo bar foo"), 0, 0, cb); err != nil {
+		t.Fatal(err)
+	}
+	var expected []MatchString
+	for _, m := range cb.MatchRules {
+		expected = append(expected, m.Strings...)
+	}
+	if len(expected) != 5 {
+		t.Fatalf("expected 5 string matches, got %+v", cb.MatchRules)
+	}
+	if !reflect.DeepEqual(cb.strings, expected) {
+		t.Errorf("expected %+v, got %+v", expected, cb.strings)
+	}
+}
+
+type sectionNamesCallback struct{ names []string }
+
+func (c *sectionNamesCallback) RuleMatching(*ScanContext, *Rule) (bool, error) {
+	return false, nil
+}
+
+func (c *sectionNamesCallback) ScanFinished(sc *ScanContext) (bool, error) {
+	pe, ok := sc.Module("pe")
+	if !ok {
+		return false, nil
+	}
+	sections, ok := pe.Field("sections")
+	if !ok {
+		return false, nil
+	}
+	n, _ := sections.Length()
+	for i := 0; i < n; i++ {
+		section, ok := sections.Item(i)
+		if !ok {
+			continue
+		}
+		if name, ok := section.Field("name"); ok {
+			s, _ := name.StringValue()
+			c.names = append(c.names, s)
+		}
+	}
+	return false, nil
+}
+
+func TestObjectArray(t *testing.T) {
+	r := makeRules(t, `import "pe" rule t { condition: pe.is_pe }`)
+	cb := &sectionNamesCallback{}
+	if err := r.ScanMem(pe32file, 0, 0, cb); err != nil {
+		t.Fatal(err)
+	}
+	if len(cb.names) != 1 || cb.names[0] == "" {
+		t.Errorf("expected one named section, got %q", cb.names)
+	}
+	t.Logf("sections: %q", cb.names)
+}
+
+func TestWriteReadAll(t *testing.T) {
+	var rs []*Rules
+	for _, s := range []string{"abc", "def", "ghi"} {
+		rs = append(rs, makeRules(t, fmt.Sprintf(`rule r_%s { strings: $a = "%s" condition: $a }`, s, s)))
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteAll(buf, rs); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadAll(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(rs) {
+		t.Fatalf("expected %d rulesets, got %d", len(rs), len(read))
+	}
+	for i, s := range []string{"abc", "def", "ghi"} {
+		var m MatchRules
+		if err := read[i].ScanMem([]byte(" abc def ghi "), 0, 0, &m); err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != 1 || m[0].Rule != "r_"+s {
+			t.Errorf("ruleset %d: unexpected matches %+v", i, m)
+		}
+	}
+}
+
+func TestInspectRules(t *testing.T) {
+	r := makeRules(t, `rule t { condition: true }`)
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	info, err := InspectRules(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, _, _ := rulesHeaderLayout(); info.FormatVersion == 0 ||
+		(size == 12 && (info.MaxThreads == 0 || info.Size == 0)) ||
+		(size == 6 && info.NumBuffers == 0) {
+		t.Errorf("unexpected header info %+v", info)
+	}
+	for _, data := range []string{"", "YARA", "rule t { condition: true }"} {
+		if _, err := InspectRules(strings.NewReader(data)); err != ErrNotCompiledRules {
+			t.Errorf("%q: expected ErrNotCompiledRules, got %v", data, err)
+		}
+	}
+}
+
+// timeoutRecorder records the modules that have been imported and
+// the rules that have matched.
+type timeoutRecorder struct {
+	MatchRules
+	imported []string
+}
+
+func (c *timeoutRecorder) ImportModule(_ *ScanContext, name string) ([]byte, bool, error) {
+	c.imported = append(c.imported, name)
+	return nil, false, nil
+}
+
+const timeoutRules = `
+		import "tests"
+		rule fast { condition: tests.constants.one == 1 }
+		rule slow { condition: for all i in (0..filesize) : ( for all j in (0..filesize) : ( uint8(i) == uint8(j) ) ) }`
+
+// checkTimeoutRecorder checks what has been recorded by a scan that
+// ran into the timeout: the module import precedes the evaluation of
+// the slow rule, but libyara reports no rule until all conditions
+// have been evaluated, so no partial matches can be returned.
+func checkTimeoutRecorder(t *testing.T, err error, cb *timeoutRecorder) {
+	if err != ErrScanTimeout {
+		t.Fatalf("expected ErrScanTimeout, got %v", err)
+	}
+	if !reflect.DeepEqual(cb.imported, []string{"tests"}) {
+		t.Errorf("expected import of tests module before timeout, got %v", cb.imported)
+	}
+	if len(cb.MatchRules) != 0 {
+		t.Errorf("expected no matches before timeout, got %+v", cb.MatchRules)
+	}
+}
+
+func TestScanMemTimeout(t *testing.T) {
+	r := makeRules(t, timeoutRules)
+	cb := &timeoutRecorder{}
+	err := r.ScanMem(make([]byte, 20000), 0, 1*time.Second, cb)
+	checkTimeoutRecorder(t, err, cb)
+}
+
+func TestBase64MatchString(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = "This program cannot" base64 $b = "abc" fullword condition: any of them }`)
+	for i := 0; i < 3; i++ {
+		plain := strings.Repeat("x", i) + "This program cannot be run in DOS mode"
+		data := []byte(base64.StdEncoding.EncodeToString([]byte(plain)))
+		var m MatchRules
+		if err := r.ScanMem(data, 0, 0, &m); err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != 1 || len(m[0].Strings) == 0 {
+			t.Errorf("alignment %d: base64 string did not match %q", i, data)
+			continue
+		}
+		for _, ms := range m[0].Strings {
+			if ms.Name != "$a" || !ms.Base64 {
+				t.Errorf("alignment %d: unexpected match string %+v", i, ms)
+			}
+		}
+	}
+	for _, rule := range r.GetRules() {
+		for _, s := range rule.Strings() {
+			switch s.Identifier() {
+			case "$a":
+				if !s.IsBase64() || s.IsBase64Wide() || s.IsFullword() {
+					t.Errorf("$a: unexpected modifiers")
+				}
+			case "$b":
+				if s.IsBase64() || !s.IsFullword() {
+					t.Errorf("$b: unexpected modifiers")
+				}
+			}
+		}
+	}
+}
+
+type abortingCallback struct{ calls int }
+
+func (c *abortingCallback) RuleMatching(*ScanContext, *Rule) (bool, error) {
+	c.calls++
+	return true, nil
+}
+
+func TestMultiCallback(t *testing.T) {
+	r := makeRules(t, `
+		import "tests"
+		rule t1 { condition: true }
+		rule t2 { condition: false }
+		rule t3 { condition: tests.module_data == "callback-data-for-tests-module" }`)
+	var m MatchRules
+	cb := newTestCallback(t)
+	if err := r.ScanMem(nil, 0, 0, MultiCallback([]ScanCallback{&m, cb})); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 {
+		t.Errorf("MatchRules: expected 2 matches, got %+v", m)
+	}
+	for _, rule := range []string{"t1", "t3"} {
+		if _, ok := cb.matched[rule]; !ok {
+			t.Errorf("RuleMatching was not called for %s", rule)
+		}
+	}
+	if _, ok := cb.notMatched["t2"]; !ok {
+		t.Error("RuleNotMatching was not called for t2")
+	}
+	if !cb.finished {
+		t.Error("ScanFinished was not called")
+	}
+
+	m = nil
+	ac := &abortingCallback{}
+	if err := r.ScanMem(nil, 0, 0, MultiCallback{ac, &m}); err != nil {
+		t.Fatal(err)
+	}
+	if ac.calls != 1 || len(m) != 1 {
+		t.Errorf("abort did not propagate: calls=%d, matches=%+v", ac.calls, m)
+	}
+}
+
+type rawRecorder struct {
+	name   string
+	events *[]string
+	abort  bool
+	err    error
+}
+
+func (c rawRecorder) RuleMatching(*ScanContext, *Rule) (bool, error) { return false, nil }
+
+func (c rawRecorder) OnMessage(_ *ScanContext, message int, data unsafe.Pointer) (bool, error) {
+	*c.events = append(*c.events, fmt.Sprintf("%s:%d:%v", c.name, message, data != nil))
+	return c.abort, c.err
+}
+
+func TestMultiCallbackOnMessage(t *testing.T) {
+	var events []string
+	var m MatchRules
+	var x int
+	mc := MultiCallback{
+		rawRecorder{name: "a", events: &events, abort: true},
+		&m,
+		rawRecorder{name: "b", events: &events},
+	}
+	abort, err := mc.OnMessage(nil, 1000, unsafe.Pointer(&x))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !abort || !reflect.DeepEqual(events, []string{"a:1000:true", "b:1000:true"}) {
+		t.Errorf("fan-out: abort=%v, events=%v", abort, events)
+	}
+
+	events = nil
+	mc = MultiCallback{
+		rawRecorder{name: "a", events: &events},
+		rawRecorder{name: "b", events: &events, err: errors.New("b failed")},
+		rawRecorder{name: "c", events: &events},
+	}
+	if _, err := mc.OnMessage(nil, 1000, nil); err == nil || err.Error() != "b failed" {
+		t.Errorf("expected error from b, got %v", err)
+	}
+	if !reflect.DeepEqual(events, []string{"a:1000:false", "b:1000:false"}) {
+		t.Errorf("error did not stop dispatch: events=%v", events)
+	}
+}
+
+// TestScanCallbackRaw feeds a message that is unknown to this package
+// through the callback function that is used by libyara, since the
+// libyara versions supported by the tests do not emit such messages.
+func TestScanCallbackRaw(t *testing.T) {
+	var events []string
+	dispatch := func(cb ScanCallback) (result interface{}) {
+		var x int
+		id := callbackData.Put(makeScanCallbackContainer(cb, nil))
+		defer callbackData.Delete(id)
+		return scanCallbackFunc(nil, 1000, unsafe.Pointer(&x), id)
+	}
+	cont := dispatch(&MatchRules{})
+	if r := dispatch(MultiCallback{rawRecorder{name: "a", events: &events}}); r != cont {
+		t.Errorf("expected CALLBACK_CONTINUE (%v), got %v", cont, r)
+	}
+	abort := dispatch(MultiCallback{&MatchRules{}, rawRecorder{name: "b", events: &events, abort: true}})
+	fail := dispatch(rawRecorder{name: "c", events: &events, err: errors.New("c failed")})
+	if abort == cont || fail == cont || abort == fail {
+		t.Errorf("expected distinct results for continue, abort, and error: %v, %v, %v", cont, abort, fail)
+	}
+	if !reflect.DeepEqual(events, []string{"a:1000:true", "b:1000:true", "c:1000:true"}) {
+		t.Errorf("unexpected events: %v", events)
+	}
+}
+
+func TestDuplicateMetas(t *testing.T) {
+	r := makeRules(t, `rule t {
+		meta:
+			reference = "https://example.com/1"
+			author = "x"
+			reference = "https://example.com/2"
+			reference = "https://example.com/3"
+		condition: true }`)
+	var refs []string
+	for _, m := range r.GetRules()[0].Metas() {
+		if m.Identifier == "reference" {
+			refs = append(refs, m.Value.(string))
+		}
+	}
+	expected := []string{"https://example.com/1", "https://example.com/2", "https://example.com/3"}
+	if !reflect.DeepEqual(refs, expected) {
+		t.Errorf("expected %v, got %v", expected, refs)
+	}
+}
+
+func TestMetaTypes(t *testing.T) {
+	r := makeRules(t, `rule t { meta: s = "x" i = -42 b = true condition: true }`)
+	expected := []Meta{{"s", "x"}, {"i", -42}, {"b", true}}
+	if got := r.GetRules()[0].Metas(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %#v, got %#v", expected, got)
+	}
+	_, err := Compile(`rule t { meta: confidence = 0.85 condition: true }`, nil)
+	var ce CompileError
+	if !errors.As(err, &ce) {
+		t.Errorf("expected CompileError for floating-point meta value, got %v", err)
+	}
+	if v := metaValue(-1, nil, 42); v != nil {
+		t.Errorf("expected nil for unknown meta type, got %#v", v)
+	}
+}
+
+func TestFastModeResult(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = "abc" condition: $a }`)
+	for _, flags := range []ScanFlags{0, ScanFlagsFastMode} {
+		var m MatchRules
+		if err := r.ScanMem([]byte(" abc abc abc "), flags, 0, &m); err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != 1 {
+			t.Fatalf("flags=%d: expected 1 match, got %d", flags, len(m))
+		}
+		if m[0].FastMode != (flags == ScanFlagsFastMode) {
+			t.Errorf("flags=%d: unexpected FastMode=%v", flags, m[0].FastMode)
+		}
+		t.Logf("flags=%d: %d string occurrences reported", flags, len(m[0].Strings))
+	}
+}
+
+func TestRuleStringStats(t *testing.T) {
+	r := makeRules(t, `
+		rule none { condition: true }
+		rule short { strings: $a = "ab" $b = "cd" condition: any of them }
+		rule long { strings: $a = "this is a long string" nocase wide ascii condition: $a }`)
+	expected := map[string]int{"none": 0, "short": 2, "long": 1}
+	for _, rule := range r.GetRules() {
+		id := rule.Identifier()
+		if n := rule.NumStrings(); n != expected[id] {
+			t.Errorf("%s: expected %d strings, got %d", id, expected[id], n)
+		}
+		if expected[id] == 0 && rule.NumAtoms() != 0 {
+			t.Errorf("%s: expected no atoms, got %d", id, rule.NumAtoms())
+		} else if expected[id] > 0 && rule.NumAtoms() < expected[id] {
+			t.Errorf("%s: expected at least %d atoms, got %d", id, expected[id], rule.NumAtoms())
+		}
+		t.Logf("%s: strings=%d atoms=%d", id, rule.NumStrings(), rule.NumAtoms())
+	}
+}
+
+func TestRulesNumAtoms(t *testing.T) {
+	simple := makeRules(t, `rule t { strings: $a = "abcdef" condition: $a }`)
+	variants := makeRules(t, `rule t { strings: $a = "abcdef" ascii wide nocase xor condition: $a }`)
+	if n, m := simple.NumAtoms(), variants.NumAtoms(); n == 0 || m <= n {
+		t.Errorf("expected more atoms with modifiers, got %d vs. %d", n, m)
+	}
+	both := makeRules(t, `
+rule a { strings: $a = "abcdef" condition: $a }
+rule b { strings: $a = "abcdef" ascii wide nocase xor condition: $a }`)
+	if n := both.NumAtoms(); n != simple.NumAtoms()+variants.NumAtoms() {
+		t.Errorf("expected sum of atoms, got %d", n)
+	}
+}
+
+func TestScanOSFile(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = "abc" fullword condition: $a }`)
+	tf, _ := ioutil.TempFile("", "TestScanOSFile")
+	defer os.Remove(tf.Name())
+	tf.Write([]byte(" abc "))
+	tf.Close()
+	f, err := os.Open(tf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var m MatchRules
+	if err := r.ScanOSFile(f, 0, 0, &m); err != nil {
+		t.Errorf("ScanOSFile(%s): %s", f.Name(), err)
+	} else if len(m) != 1 {
+		t.Errorf("ScanOSFile: expected 1 match, got %d", len(m))
+	}
+	if _, err := f.Stat(); err != nil {
+		t.Errorf("file is no longer usable after ScanOSFile: %v", err)
+	}
+}
+
+func TestMagicDatabasePath(t *testing.T) {
+	c, err := NewCompiler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddString(`import "magic"
+rule t { condition: magic.type() contains "go-yara test data" }`, ""); err != nil {
+		t.Skip("magic module not available:", err)
+	}
+	r, err := c.GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := ioutil.TempFile("", "TestMagicDatabasePath")
+	defer os.Remove(f.Name())
+	f.Write([]byte("0\tstring\tGOYARA\tgo-yara test data\n"))
+	f.Close()
+	if err := SetMagicDatabasePath(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("MAGIC")
+	var m MatchRules
+	if err := r.ScanMem([]byte("GOYARA magic"), 0, 0, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Errorf("expected 1 match, got %d", len(m))
+	}
+}
+
+func TestRuleString(t *testing.T) {
+	r := makeRules(t, `
+rule a : foo bar { meta: author = "me" score = 5 condition: true }
+rule b { condition: true }`)
+	expected := []string{
+		`default:a [foo bar] {author="me", score=5}`,
+		`default:b`,
+	}
+	for i, rule := range r.GetRules() {
+		if s := rule.String(); s != expected[i] {
+			t.Errorf("expected %s, got %s", expected[i], s)
+		}
+	}
+}
+
+func TestRuleSummary(t *testing.T) {
+	r := makeRules(t, `
+private rule t : foo {
+	meta:
+		author = "me"
+	strings:
+		$a = "abc" nocase wide fullword
+		$b = { 01 02 03 }
+		$c = /a.c/
+	condition:
+		any of them
+}`)
+	s := r.GetRules()[0].Summary()
+	if s.Namespace != "default" || s.Identifier != "t" || !s.Private || s.Global {
+		t.Errorf("unexpected rule summary: %+v", s)
+	}
+	if !reflect.DeepEqual(s.Tags, []string{"foo"}) {
+		t.Errorf("unexpected tags: %v", s.Tags)
+	}
+	if !reflect.DeepEqual(s.Metas, []Meta{{"author", "me"}}) {
+		t.Errorf("unexpected metas: %v", s.Metas)
+	}
+	if len(s.Strings) != 3 {
+		t.Fatalf("expected 3 strings, got %d", len(s.Strings))
+	}
+	a := s.Strings[0]
+	if a.Identifier != "$a" || a.Type != "text" || string(a.Value) != "abc" ||
+		!reflect.DeepEqual(a.Modifiers, []string{"nocase", "wide", "fullword"}) {
+		t.Errorf("unexpected summary for $a: %+v", a)
+	}
+	if b := s.Strings[1]; b.Identifier != "$b" || b.Type != "hex" {
+		t.Errorf("unexpected summary for $b: %+v", b)
+	}
+	if c := s.Strings[2]; c.Identifier != "$c" || c.Type != "regexp" {
+		t.Errorf("unexpected summary for $c: %+v", c)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	r := makeRules(t, `rule t { condition: true }`)
+	var m MatchRules
+	err := r.ScanFile("/nonexistent/file", 0, 0, &m)
+	var yerr Error
+	if !errors.As(err, &yerr) {
+		t.Fatalf("expected Error, got %T: %v", err, err)
+	}
+	if yerr.Code() == 0 || yerr.Error() == "" {
+		t.Errorf("unexpected error code %d (%v)", yerr.Code(), yerr)
+	}
+	if errors.Is(err, ErrScanTimeout) {
+		t.Errorf("%v should not match ErrScanTimeout", err)
+	}
+	if !errors.Is(Error(yerr.Code()), yerr) {
+		t.Errorf("errors.Is does not match error with code %d", yerr.Code())
+	}
+}
+
+func TestScanMemGrouped(t *testing.T) {
+	c, err := NewCompiler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []struct{ rule, ns string }{
+		{`rule a { condition: true }`, "one"},
+		{`rule b { condition: true }`, "two"},
+		{`rule c { condition: true }`, "two"},
+		{`rule d { condition: true }`, ""},
+	} {
+		if err := c.AddString(src.rule, src.ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := c.GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := r.ScanMemGrouped([]byte("dummy"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"one":     {"a"},
+		"two":     {"b", "c"},
+		"default": {"d"},
+	}
+	if len(groups) != len(expected) {
+		t.Errorf("expected %d namespaces, got %d", len(expected), len(groups))
+	}
+	for ns, ids := range expected {
+		var got []string
+		for _, m := range groups[ns] {
+			got = append(got, m.Rule)
+		}
+		if !reflect.DeepEqual(got, ids) {
+			t.Errorf("namespace %s: expected %v, got %v", ns, ids, got)
+		}
+	}
+}
+
+func TestScanForRules(t *testing.T) {
+	r := makeRules(t, `
+		rule a { condition: true }
+		rule b { condition: true }
+		rule c { condition: true }`)
+	r.GetRules()[2].Disable()
+	m, err := r.ScanForRules([]byte("dummy"), []string{"b", "default:c"}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m[0].Rule != "b" || m[1].Rule != "c" {
+		t.Errorf("expected matches for b and c, got %+v", m)
+	}
+	if _, err := r.ScanForRules([]byte("dummy"), []string{"d"}, 0, 0); err == nil {
+		t.Error("ScanForRules did not fail for unknown rule")
+	}
+	var all MatchRules
+	if err := r.ScanMem([]byte("dummy"), 0, 0, &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Rule != "a" || all[1].Rule != "b" {
+		t.Errorf("rule state was not restored after ScanForRules: got %+v", all)
+	}
+}
+
+func TestScanMemWithModuleData(t *testing.T) {
+	r := makeRules(t, `
+		import "tests"
+		rule t { condition: tests.module_data == "injected" }`)
+	m, err := r.ScanMemWithModuleData([]byte("dummy"), map[string][]byte{"tests": []byte("injected")}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Errorf("expected 1 match, got %d", len(m))
+	}
+	if m, err = r.ScanMemWithModuleData([]byte("dummy"), nil, 0, 0); err != nil {
+		t.Fatal(err)
+	} else if len(m) != 0 {
+		t.Errorf("expected no match without module data, got %d", len(m))
+	}
+}
+
+func TestModuleDataWithNUL(t *testing.T) {
+	r := makeRules(t, `
+		import "tests"
+		rule t { condition: tests.module_data == "in\x00jected\x00" }`)
+	m, err := r.ScanMemWithModuleData([]byte("dummy"), map[string][]byte{"tests": []byte("in\x00jected\x00")}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Errorf("module data has not been passed in full")
+	}
+}
+
+func TestExternalVariables(t *testing.T) {
+	r, err := Compile(`rule t { condition: b and i > 0 and s == "x" and f > 0.0 }`,
+		map[string]interface{}{"b": true, "i": int64(42), "s": "x", "f": 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]ExternalVar)
+	for _, v := range r.ExternalVariables() {
+		got[v.Name] = v
+	}
+	expected := map[string]ExternalVar{
+		"b": {"b", "boolean", true},
+		"i": {"i", "integer", int64(42)},
+		"s": {"s", "string", "x"},
+		"f": {"f", "float", 1.5},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+type matchingRulesCallback []string
+
+func (c *matchingRulesCallback) RuleMatching(*ScanContext, *Rule) (bool, error) {
+	return false, nil
+}
+
+func (c *matchingRulesCallback) ScanFinished(sc *ScanContext) (bool, error) {
+	for _, r := range sc.MatchingRules() {
+		*c = append(*c, r.Identifier())
+	}
+	return false, nil
+}
+
+func TestScanContextMatchingRules(t *testing.T) {
+	r := makeRules(t, `
+		private rule helper { strings: $a = "abc" condition: $a }
+		private rule unused { strings: $a = "xyz" condition: $a }
+		rule public { condition: helper }`)
+	var cb matchingRulesCallback
+	if err := r.ScanMem([]byte(" abc "), 0, 0, &cb); err != nil {
+		t.Fatal(err)
+	}
+	expected := matchingRulesCallback{"helper", "public"}
+	if !reflect.DeepEqual(cb, expected) {
+		t.Errorf("expected %v, got %v", expected, cb)
+	}
+}
+
+type failingCallback struct{}
+
+func (failingCallback) RuleMatching(*ScanContext, *Rule) (bool, error) {
+	return false, errors.New("failing callback")
+}
+
+func TestSetLogger(t *testing.T) {
+	var logged []string
+	SetLogger(func(msg string) { logged = append(logged, msg) })
+	defer SetLogger(nil)
+	r := makeRules(t, `rule t { condition: true }`)
+	var m MatchRules
+	if err := r.ScanMem([]byte("dummy"), 0, 0, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(logged) != 1 || !strings.Contains(logged[0], "scan finished") {
+		t.Errorf("expected scan finished message, got %q", logged)
+	}
+	logged = nil
+	if err := r.ScanMem([]byte("dummy"), 0, 0, failingCallback{}); err == nil {
+		t.Fatal("expected error from failing callback")
+	}
+	if len(logged) == 0 || !strings.Contains(logged[0], "failing callback") {
+		t.Errorf("expected callback error to be logged, got %q", logged)
+	}
+}
+
+type tooManyMatchesCallback struct {
+	MatchRules
+	strings []string
+}
+
+func (c *tooManyMatchesCallback) TooManyMatches(_ *ScanContext, s *String) (bool, error) {
+	c.strings = append(c.strings, s.Identifier())
+	return false, nil
+}
+
+func TestTooManyMatches(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = "a" condition: $a }`)
+	buf := bytes.Repeat([]byte("a"), 1000001)
+	var m MatchRules
+	if err := r.ScanMem(buf, 0, 0, &m); err == nil {
+		t.Error("expected scan to fail without TooManyMatches")
+	}
+	var cb tooManyMatchesCallback
+	err := r.ScanMem(buf, 0, 0, &cb)
+	if err == ErrTooManyMatches {
+		t.Skip("libyara does not support CALLBACK_MSG_TOO_MANY_MATCHES")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cb.strings, []string{"$a"}) {
+		t.Errorf("expected TooManyMatches for $a, got %v", cb.strings)
+	}
+	if len(cb.MatchRules) != 1 {
+		t.Errorf("expected rule to match, got %d matches", len(cb.MatchRules))
+	}
+}
+
+func TestStringRule(t *testing.T) {
+	r := makeRules(t, `
+		rule a { strings: $a = "abc" condition: $a }
+		rule b { strings: $b = "def" condition: $b }`)
+	for _, rule := range r.GetRules() {
+		for _, s := range rule.Strings() {
+			if owner := s.Rule(); owner == nil || owner.Identifier() != rule.Identifier() {
+				t.Errorf("%s: expected owner %s, got %v", s.Identifier(), rule.Identifier(), owner)
+			}
+			detached := String{cptr: s.cptr, rules: r}
+			if owner := detached.Rule(); owner == nil || owner.Identifier() != rule.Identifier() {
+				t.Errorf("%s: expected owner %s after search, got %v", s.Identifier(), rule.Identifier(), owner)
+			}
+		}
+	}
+}
+
+func TestMaxMatchData(t *testing.T) {
+	old, err := GetConfiguration(ConfigMaxMatchData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetConfiguration(ConfigMaxMatchData, old)
+	if err := SetConfiguration(ConfigMaxMatchData, 16); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := GetConfiguration(ConfigMaxMatchData); err != nil {
+		t.Fatal(err)
+	} else if v != 16 {
+		t.Errorf("expected ConfigMaxMatchData=16, got %v", v)
+	}
+	s := strings.Repeat("0123456789", 4)
+	r := makeRules(t, `rule t { strings: $a = "`+s+`" condition: $a }`)
+	var m MatchRules
+	if err := r.ScanMem([]byte(" "+s+" "), 0, 0, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || len(m[0].Strings) != 1 {
+		t.Fatalf("expected one string match, got %+v", m)
+	}
+	ms := m[0].Strings[0]
+	if string(ms.Data) != s[:16] || ms.Length != len(s) {
+		t.Errorf("expected 16 bytes of data and length %d, got %q and %d", len(s), ms.Data, ms.Length)
+	}
+}
+
+type modulesCallback []string
+
+func (c *modulesCallback) RuleMatching(*ScanContext, *Rule) (bool, error) {
+	return false, nil
+}
+
+func (c *modulesCallback) ScanFinished(sc *ScanContext) (bool, error) {
+	for name := range sc.Modules() {
+		*c = append(*c, name)
+	}
+	return false, nil
+}
+
+func TestScanContextModules(t *testing.T) {
+	r, err := Compile(`import "pe" import "math" rule t { condition: pe.is_pe and ext }`,
+		map[string]interface{}{"ext": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cb modulesCallback
+	if err := r.ScanMem(pe32file, 0, 0, &cb); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(cb)
+	if expected := (modulesCallback{"math", "pe"}); !reflect.DeepEqual(cb, expected) {
+		t.Errorf("expected modules %v, got %v", expected, cb)
+	}
+}
+
+func TestResults(t *testing.T) {
+	r := makeRules(t, `
+		rule t : tag {
+			meta: s = "str" i = -3 b = true
+			strings: $a = "abc"
+			condition: $a
+		}`)
+	var m MatchRules
+	if err := r.ScanMem([]byte(" abc "), 0, 0, &m); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Result{{
+		Rule:      "t",
+		Namespace: "default",
+		Tags:      []string{"tag"},
+		Metas: []ResultMeta{
+			{"s", MetaValue{Type: MetaTypeString, S: "str"}},
+			{"i", MetaValue{Type: MetaTypeInteger, I: -3}},
+			{"b", MetaValue{Type: MetaTypeBoolean, B: true}},
+		},
+		Strings: []MatchString{{Name: "$a", Offset: 1, Length: 3, Data: []byte("abc")}},
+	}}
+	if got := m.Results(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestSampleReScan(t *testing.T) {
+	s := NewSample([]byte(" abc def "))
+	m, err := s.ReScan(`rule a { strings: $a = "abc" condition: $a }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m[0].Rule != "a" {
+		t.Errorf("expected match for a, got %+v", m)
+	}
+	m, err = s.ReScan(`rule a { strings: $a = "abc" condition: $a }
+		rule d { strings: $d = "def" condition: $d }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m[1].Rule != "d" {
+		t.Errorf("expected matches for a and d, got %+v", m)
+	}
+	if _, err = s.ReScan(`rule broken { condition: $x }`); err == nil {
+		t.Error("expected compile error")
+	} else if len(s.Errors) == 0 {
+		t.Errorf("compiler errors were not recorded for %v", err)
+	}
+}
+
+func TestModuleFunctionInRule(t *testing.T) {
+	c, err := NewCompiler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DefineVariable("imphash", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddString(`import "pe"
+rule known_imphash { condition: pe.imphash() == imphash }`, ""); err != nil {
+		t.Skip("pe.imphash() not available:", err)
+	}
+	r, err := c.GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewScanner(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m MatchRules
+	if err := s.DefineVariable("imphash", "0123456789abcdef0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetCallback(&m).ScanMem(pe32file); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 0 {
+		t.Errorf("unexpected match for made-up imphash: %+v", m)
+	}
+	// pe32file has no import directory, so its imphash is the MD5
+	// hash of the empty import list.
+	m = nil
+	if err := s.DefineVariable("imphash", fmt.Sprintf("%x", md5.Sum(nil))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ScanMem(pe32file); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m[0].Rule != "known_imphash" {
+		t.Errorf("expected match for imphash of empty import list, got %+v", m)
+	}
+}
+
+func TestMatchStringData(t *testing.T) {
+	ms := MatchString{Data: []byte("ab\x00\"\xffz")}
+	if got, want := ms.HexData(), "61620022ff7a"; got != want {
+		t.Errorf("HexData: got %q, want %q", got, want)
+	}
+	if got, want := ms.PrintableData(), `ab\x00"\xFFz`; got != want {
+		t.Errorf("PrintableData: got %q, want %q", got, want)
+	}
+	for data, want := range map[string]string{
+		"a\\b":        `a\\b`,
+		"a\nb\r\n":    `a\nb\r\n`,
+		"\tx\x7f\x1b": `\tx\x7F\x1B`,
+	} {
+		ms := MatchString{Data: []byte(data)}
+		if got := ms.PrintableData(); got != want {
+			t.Errorf("PrintableData(%q): got %q, want %q", data, got, want)
+		}
+	}
+}
+
+func TestMatchCollectorSource(t *testing.T) {
+	r := makeRules(t, `rule t { condition: true }`)
+	var m MatchRules
+	if err := r.ScanMem([]byte(""), 0, 0, m.Collector().SetSource("sample.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m[0].Source != "sample.bin" {
+		t.Fatalf("unexpected matches: %+v", m)
+	}
+	if res := m.Results(); res[0].Source != "sample.bin" {
+		t.Errorf("Source not copied to Result: %+v", res[0])
+	}
+}
+
+func TestNilCallback(t *testing.T) {
+	r := makeRules(t, `rule t { condition: true }`)
+	if err := r.ScanMem([]byte(""), 0, 0, nil); err != nil {
+		t.Errorf("nil interface: %v", err)
+	}
+	var m *MatchRules
+	if err := r.ScanMem([]byte(""), 0, 0, m); err != ErrNilCallback {
+		t.Errorf("nil pointer: expected ErrNilCallback, got %v", err)
+	}
+	s, err := NewScanner(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetCallback(m).ScanMem([]byte("")); err != ErrNilCallback {
+		t.Errorf("scanner, nil pointer: expected ErrNilCallback, got %v", err)
+	}
+}
+
+func TestMatchCollectorTagFilter(t *testing.T) {
+	r := makeRules(t, `
+rule a : red { condition: true }
+rule b : green blue { condition: true }
+rule c { condition: true }
+rule d : blue { condition: true }`)
+	var m MatchRules
+	if err := r.ScanMem([]byte(""), 0, 0, m.Collector().SetTagFilter([]string{"blue", "yellow"})); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, mr := range m {
+		names = append(names, mr.Rule)
+	}
+	if expected := []string{"b", "d"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestStringMatchCounts(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = "abc" $b = "def" $c = "xyz" condition: $a or $b }`)
+	var m MatchRules
+	if err := r.ScanMem([]byte(" abc def abc abc "), 0, 0, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Fatalf("unexpected matches: %+v", m)
+	}
+	expected := map[string]int{"$a": 3, "$b": 1}
+	if !reflect.DeepEqual(m[0].StringMatchCounts, expected) {
+		t.Errorf("expected %v, got %v", expected, m[0].StringMatchCounts)
+	}
+}
+
+func TestResultsDeterministic(t *testing.T) {
+	r := makeRules(t, `
+import "math"
+rule a : t1 t2 { meta: x = 1 y = "two" z = true strings: $a = "abc" $b = "def" condition: any of them }
+rule b { condition: math.entropy(0, filesize) > 1 }
+rule c { strings: $c = /ab./ condition: #c > 1 }`)
+	buf := []byte(" abc def abcabc abd ")
+	var results [][]Result
+	for i := 0; i < 2; i++ {
+		var m MatchRules
+		if err := r.ScanMem(buf, 0, 0, &m); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, m.Results())
+	}
+	if len(results[0]) != 3 {
+		t.Fatalf("unexpected results: %+v", results[0])
+	}
+	if !reflect.DeepEqual(results[0], results[1]) {
+		t.Errorf("results differ:\n%+v\n%+v", results[0], results[1])
+	}
+}
+
+func TestSortBySeverity(t *testing.T) {
+	r := makeRules(t, `
+rule low { meta: severity = 1 condition: true }
+rule none { condition: true }
+rule high { meta: severity = 10 condition: true }
+rule text { meta: severity = "high" condition: true }
+rule medium { meta: severity = 5 condition: true }`)
+	var m MatchRules
+	if err := r.ScanMem([]byte(""), 0, 0, &m); err != nil {
+		t.Fatal(err)
+	}
+	m.SortBySeverity("severity")
+	var names []string
+	for _, mr := range m {
+		names = append(names, mr.Rule)
+	}
+	if expected := []string{"high", "medium", "low", "none", "text"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestMatchCollectorContextBytes(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = "abc" condition: $a }`)
+	var m MatchRules
+	if err := r.ScanMem([]byte("abc 0123abc4567 abc"), 0, 0, m.Collector().SetContextBytes(4)); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || len(m[0].Strings) != 3 {
+		t.Fatalf("unexpected matches: %+v", m)
+	}
+	for i, expected := range []struct {
+		context string
+		offset  int
+	}{
+		{"abc 012", 0},
+		{"0123abc4567", 4},
+		{"567 abc", 4},
+	} {
+		ms := m[0].Strings[i]
+		if string(ms.Context) != expected.context || ms.ContextOffset != expected.offset {
+			t.Errorf("match %d: expected context %q at %d, got %q at %d",
+				i, expected.context, expected.offset, ms.Context, ms.ContextOffset)
+		}
+	}
+}
+
+func TestImportedModules(t *testing.T) {
+	r := makeRules(t, `
+import "math"
+import "tests"
+rule a { condition: math.entropy(0, filesize) >= 0 }
+rule b { condition: true }`)
+	modules, err := r.ImportedModules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"math", "tests"}; !reflect.DeepEqual(modules, expected) {
+		t.Errorf("expected %v, got %v", expected, modules)
+	}
+}
+
+func TestDiffMatches(t *testing.T) {
+	oldRules := makeRules(t, `
+rule kept { strings: $a = "abc" condition: $a }
+rule dropped { condition: true }
+rule changed { strings: $a = "abc" condition: $a }`)
+	newRules := makeRules(t, `
+rule kept { strings: $a = "abc" condition: $a }
+rule changed { strings: $a = "def" condition: $a }
+rule new { condition: true }`)
+	buf := []byte(" abc def ")
+	var oldMatches, newMatches MatchRules
+	if err := oldRules.ScanMem(buf, 0, 0, &oldMatches); err != nil {
+		t.Fatal(err)
+	}
+	if err := newRules.ScanMem(buf, 0, 0, &newMatches); err != nil {
+		t.Fatal(err)
+	}
+	names := func(m MatchRules) (names []string) {
+		for _, mr := range m {
+			names = append(names, mr.Rule)
+		}
+		return
+	}
+	added, removed := DiffMatches(oldMatches, newMatches)
+	if expected := []string{"changed", "new"}; !reflect.DeepEqual(names(added), expected) {
+		t.Errorf("added: expected %v, got %v", expected, names(added))
+	}
+	if expected := []string{"dropped", "changed"}; !reflect.DeepEqual(names(removed), expected) {
+		t.Errorf("removed: expected %v, got %v", expected, names(removed))
+	}
+	if added, removed := DiffMatches(oldMatches, oldMatches); len(added) != 0 || len(removed) != 0 {
+		t.Errorf("identical sets: got added %v, removed %v", names(added), names(removed))
+	}
+}
+
+func TestGlobalRules(t *testing.T) {
+	r := makeRules(t, `
+global rule g1 { condition: filesize < 1000 }
+rule a { condition: true }
+global private rule g2 { condition: true }
+private rule p { condition: true }`)
+	var names []string
+	for _, rule := range r.GlobalRules() {
+		names = append(names, rule.Identifier())
+	}
+	if expected := []string{"g1", "g2"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestRulesWithTag(t *testing.T) {
+	r := makeRules(t, `
+rule a : foo { condition: true }
+rule b : foo bar { condition: true }
+rule c : bar { condition: true }
+rule d { condition: true }`)
+	for tag, expected := range map[string][]string{
+		"foo": {"a", "b"},
+		"bar": {"b", "c"},
+		"baz": nil,
+	} {
+		var names []string
+		for _, rule := range r.RulesWithTag(tag) {
+			names = append(names, rule.Identifier())
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("%s: expected %v, got %v", tag, expected, names)
+		}
+	}
+}
+
+func TestChainedStringLength(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = { 41 41 41 41 [250-350] 42 42 42 42 } condition: $a }`)
+	buf := append([]byte("xxAAAA"), make([]byte, 300)...)
+	buf = append(buf, "BBBBxx"...)
+	var m MatchRules
+	if err := r.ScanMem(buf, 0, 0, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || len(m[0].Strings) != 1 {
+		t.Fatalf("unexpected matches: %+v", m)
+	}
+	if ms := m[0].Strings[0]; ms.Offset != 2 || ms.Length != 308 {
+		t.Errorf("expected match at 2 with length 308, got %d/%d", ms.Offset, ms.Length)
+	}
+}
+
+func TestRuleFlags(t *testing.T) {
+	r := makeRules(t, `
+rule a { condition: true }
+private rule p { condition: true }
+global rule g { condition: true }
+global private rule gp { condition: true }`)
+	expected := map[string]uint32{"a": 0, "p": 0x01, "g": 0x02, "gp": 0x03}
+	for _, rule := range r.GetRules() {
+		if got := rule.Flags() & 0x03; got != expected[rule.Identifier()] {
+			t.Errorf("%s: expected flags %#x, got %#x", rule.Identifier(), expected[rule.Identifier()], got)
+		}
+	}
+	rule := r.GetRules()[0]
+	rule.Disable()
+	if rule.Flags()&0x08 == 0 {
+		t.Errorf("expected disabled flag to be set, got %#x", rule.Flags())
+	}
+	rule.Enable()
+}
+
+func TestOverlappingMatches(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = { 00 00 } condition: $a }`)
+	var m MatchRules
+	if err := r.ScanMem(make([]byte, 10), 0, 0, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Fatalf("unexpected matches: %+v", m)
+	}
+	if len(m[0].Strings) != 9 {
+		t.Errorf("expected 9 overlapping matches, got %d", len(m[0].Strings))
+	}
+	for i, ms := range m[0].Strings {
+		if ms.Offset != uint64(i) {
+			t.Errorf("match %d: unexpected offset %d", i, ms.Offset)
+		}
+	}
+}
+
+func TestLoadRulesFromBytes(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = "abc" condition: $a }`)
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadRulesFromBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m MatchRules
+	if err := loaded.ScanMem([]byte(" abc "), 0, 0, &m); err != nil || len(m) != 1 {
+		t.Errorf("scan with loaded rules: %v, %+v", err, m)
+	}
+	_, versionOffset, ok := rulesHeaderLayout()
+	if !ok {
+		t.Skip("unknown header layout")
+	}
+	data := buf.Bytes()
+	data[versionOffset] ^= 0xff // file format version
+	if _, err := LoadRulesFromBytes(data); err == nil || !strings.Contains(err.Error(), Version()) {
+		t.Errorf("expected version mismatch error, got %v", err)
+	}
+}
+
+func TestRulesClone(t *testing.T) {
+	r := makeRules(t, `rule t { strings: $a = "abc" condition: $a }`)
+	clone, err := r.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m MatchRules
+	if err := clone.ScanMem([]byte(" abc "), 0, 0, &m); err != nil || len(m) != 1 {
+		t.Errorf("scan with clone: %v, %+v", err, m)
+	}
+	clone.Destroy()
+	m = nil
+	if err := r.ScanMem([]byte(" abc "), 0, 0, &m); err != nil || len(m) != 1 {
+		t.Errorf("scan with original after destroying clone: %v, %+v", err, m)
+	}
+	r.Destroy()
+	if _, err := r.Clone(); err != ErrRulesReleased {
+		t.Errorf("expected ErrRulesReleased, got %v", err)
+	}
+}
+
+func TestMalformedModuleInput(t *testing.T) {
+	r := makeRules(t, `
+import "pe"
+rule is_pe { condition: pe.is_pe }
+rule always { condition: true }`)
+	for _, n := range []int{0, 2, 64, 0x80, len(pe32file) / 2} {
+		var m MatchRules
+		if err := r.ScanMem(pe32file[:n], 0, 0, &m); err != nil {
+			t.Errorf("%d bytes: %v", n, err)
+			continue
+		}
+		if len(m) == 0 || m[len(m)-1].Rule != "always" {
+			t.Errorf("%d bytes: unexpected matches %+v", n, m)
+		}
+	}
+}
+
+// TestOversizedModuleInput scans a PE file whose headers claim far
+// more sections, image size, and import data than the file contains.
+// libyara's allocations cannot be observed from Go, so this only
+// checks that the scan completes and that the header values are
+// reported as found rather than rejected or trusted for parsing.
+func TestOversizedModuleInput(t *testing.T) {
+	r := makeRules(t, `
+import "pe"
+rule is_pe { condition: pe.is_pe }
+rule sections { condition: pe.number_of_sections == 0xffff }
+rule always { condition: true }`)
+	buf := append([]byte{}, pe32file...)
+	hdr := int(binary.LittleEndian.Uint32(buf[0x3c:]))
+	opt := hdr + 24
+	binary.LittleEndian.PutUint16(buf[hdr+6:], 0xffff)         // NumberOfSections
+	binary.LittleEndian.PutUint32(buf[opt+56:], 0xffffffff)    // SizeOfImage
+	binary.LittleEndian.PutUint32(buf[opt+96+8:], uint32(hdr)) // import directory RVA
+	binary.LittleEndian.PutUint32(buf[opt+96+12:], 0xfffffff0) // import directory size
+	start := time.Now()
+	var m MatchRules
+	if err := r.ScanMem(buf, 0, 0, &m); err != nil {
+		t.Fatal(err)
+	}
+	var rules []string
+	for _, mr := range m {
+		rules = append(rules, mr.Rule)
+	}
+	if !reflect.DeepEqual(rules, []string{"is_pe", "sections", "always"}) {
+		t.Errorf("unexpected matches: %v", rules)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("scan took %v", d)
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	old, err := GetConfiguration(ConfigStackSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetConfiguration(ConfigStackSize, old)
+	condition := "1" + strings.Repeat(" + (1", 64) + strings.Repeat(")", 64) + " > 0"
+	r := makeRules(t, "rule deep { condition: "+condition+" }")
+	if err := SetConfiguration(ConfigStackSize, 16); err != nil {
+		t.Fatal(err)
+	}
+	var m MatchRules
+	if err := r.ScanMem([]byte(""), 0, 0, &m); err != ErrStackOverflow {
+		t.Errorf("small stack: expected ErrStackOverflow, got %v", err)
+	}
+	if err := SetConfiguration(ConfigStackSize, 1024); err != nil {
+		t.Fatal(err)
+	}
+	m = nil
+	if err := r.ScanMem([]byte(""), 0, 0, &m); err != nil {
+		t.Errorf("large stack: %v", err)
+	} else if len(m) != 1 {
+		t.Errorf("large stack: unexpected matches %+v", m)
+	}
+}
+
+type slowModuleData struct{ delay time.Duration }
+
+func (c *slowModuleData) RuleMatching(*ScanContext, *Rule) (bool, error) { return false, nil }
+
+func (c *slowModuleData) ImportModule(*ScanContext, string) ([]byte, bool, error) {
+	time.Sleep(c.delay)
+	return []byte("slow"), false, nil
+}
+
+func TestModuleImportTimeout(t *testing.T) {
+	src := `import "tests"` + "\n"
+	for i := 0; i < 20; i++ {
+		src += fmt.Sprintf("rule r%d { condition: tests.module_data == \"slow\" and filesize == 0 }\n", i)
+	}
+	r := makeRules(t, src)
+	var m MatchRules
+	err := r.ScanMem([]byte(""), 0, 1*time.Second, MultiCallback{&m, &slowModuleData{1500 * time.Millisecond}})
+	if err != ErrScanTimeout {
+		t.Errorf("expected ErrScanTimeout, got %v (%d matches)", err, len(m))
+	}
+}
+
+type startCallback struct {
+	events []string
+	err    error
+	// data is set if scan data was accessible from ScanStarting.
+	data bool
+}
+
+func (c *startCallback) ScanStarting(sc *ScanContext) error {
+	c.events = append(c.events, "start")
+	if n, _ := sc.ReadAt(make([]byte, 1), 0); n > 0 || len(sc.MatchingRules()) > 0 || len(sc.MatchedStrings()) > 0 {
+		c.data = true
+	}
+	return c.err
+}
+
+func (c *startCallback) RuleMatching(_ *ScanContext, r *Rule) (bool, error) {
+	c.events = append(c.events, r.Identifier())
+	return false, nil
+}
+
+func (c *startCallback) ScanFinished(*ScanContext) (bool, error) {
+	c.events = append(c.events, "finish")
+	return false, nil
+}
+
+func TestScanCallbackStart(t *testing.T) {
+	r := makeRules(t, `rule a { condition: true } rule b { condition: true }`)
+	expected := []string{"start", "a", "b", "finish"}
+	cb := &startCallback{}
+	if err := r.ScanMem([]byte("foo"), 0, 0, cb); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cb.events, expected) {
+		t.Errorf("Rules: expected %v, got %v", expected, cb.events)
+	}
+	s, err := NewScanner(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy()
+	// The second scan reuses the scanner's context; data left from
+	// the first scan must not be visible from ScanStarting.
+	for i := 0; i < 2; i++ {
+		cb = &startCallback{}
+		if err := s.SetCallback(cb).ScanMem([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cb.events, expected) {
+			t.Errorf("Scanner: expected %v, got %v", expected, cb.events)
+		}
+		if cb.data {
+			t.Errorf("scan %d: scan data accessible from ScanStarting", i)
+		}
+	}
+	cb = &startCallback{err: errors.New("setup failed")}
+	if err := r.ScanMem([]byte("foo"), 0, 0, MultiCallback{cb}); err != cb.err {
+		t.Errorf("expected setup error, got %v", err)
+	}
+	if !reflect.DeepEqual(cb.events, []string{"start"}) {
+		t.Errorf("expected scan not to run, got %v", cb.events)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright © 2015-2020 Hilko Bengen <bengen@hilluzination.de>
+// All rights reserved.
+//
+// Use of this source code is governed by the license that can be
+// found in the LICENSE file.
+
+package yara
+
+import "time"
+
+// A Sample holds a buffer that is scanned repeatedly using different
+// versions of a set of rules, e.g. while rules are being developed.
+type Sample struct {
+	buf []byte
+	// Flags and Timeout are used for every scan.
+	Flags   ScanFlags
+	Timeout time.Duration
+	// Errors and Warnings contain the messages recorded by the
+	// compiler during the most recent call to ReScan.
+	Errors   []CompilerMessage
+	Warnings []CompilerMessage
+}
+
+// NewSample creates a Sample that holds buf. The buffer is not
+// copied and must not be modified while the Sample is used.
+func NewSample(buf []byte) *Sample {
+	return &Sample{buf: buf}
+}
+
+// ReScan compiles source and scans the sample's buffer using the
+// resulting rules. If the rules cannot be compiled, the compiler's
+// error is returned; all messages can be retrieved from the Errors
+// and Warnings fields.
+func (s *Sample) ReScan(source string) (MatchRules, error) {
+	c, err := NewCompiler()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Destroy()
+	err = c.AddString(source, "")
+	s.Errors, s.Warnings = c.Errors, c.Warnings
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.GetRules()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Destroy()
+	var m MatchRules
+	if err := r.ScanMem(s.buf, s.Flags, s.Timeout, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -25,8 +25,11 @@ int scanCallbackFunc(YR_SCAN_CONTEXT*, int, void*, void*);
 */
 import "C"
 import (
+	"context"
 	"errors"
+	"os"
 	"runtime"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -36,6 +39,12 @@ import (
 // thread-safe manner (cf.
 // https://github.com/VirusTotal/yara/issues/350).
 //
+// The atoms and the Aho-Corasick automaton are part of the compiled
+// Rules and are never rebuilt for a scan. However, each of the
+// (*Rules).ScanXxx methods creates and destroys a scanner internally,
+// so reusing a Scanner amortizes that setup when many small buffers
+// are scanned.
+//
 // Since this type contains a C pointer to a YR_SCANNER structure that
 // may be automatically freed, it should not be copied.
 type Scanner struct {
@@ -47,10 +56,20 @@ type Scanner struct {
 	Callback ScanCallback
 	// Scan flags are set just before scanning.
 	flags ScanFlags
+	// Statistics about the most recent scan
+	stats ScanStats
+	// Timeout and variables are recorded for Clone.
+	timeout   time.Duration
+	variables map[string]interface{}
+	// Module data provider, set by SetModuleDataProvider
+	moduleData ModuleDataProvider
 }
 
 // NewScanner creates a YARA scanner.
 func NewScanner(r *Rules) (*Scanner, error) {
+	if r.cptr == nil {
+		return nil, ErrRulesReleased
+	}
 	var yrScanner *C.YR_SCANNER
 	if err := newError(C.yr_scanner_create(r.cptr, &yrScanner)); err != nil {
 		return nil, err
@@ -60,6 +79,25 @@ func NewScanner(r *Rules) (*Scanner, error) {
 	return s, nil
 }
 
+// Clone creates a new scanner for the same ruleset, with the flags,
+// timeout, variables, and module data provider that have been set for
+// s. The callback object
+// is not copied.
+func (s *Scanner) Clone() (*Scanner, error) {
+	c, err := NewScanner(s.rules)
+	if err != nil {
+		return nil, err
+	}
+	c.SetFlags(s.flags).SetTimeout(s.timeout).SetModuleDataProvider(s.moduleData)
+	for identifier, value := range s.variables {
+		if err := c.DefineVariable(identifier, value); err != nil {
+			c.Destroy()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
 // Destroy destroys the YARA data structure representing a scanner.
 //
 // It should not be necessary to call this method directly.
@@ -72,7 +110,9 @@ func (s *Scanner) Destroy() {
 }
 
 // DefineVariable defines a named variable for use by the scanner.
-// Boolean, int64, float64, and string types are supported.
+// Boolean, int64, float64, and string types are supported. A
+// time.Time value is defined as an integer variable containing the
+// number of seconds since the Unix epoch.
 func (s *Scanner) DefineVariable(identifier string, value interface{}) (err error) {
 	cid := C.CString(identifier)
 	defer C.free(unsafe.Pointer(cid))
@@ -84,10 +124,16 @@ func (s *Scanner) DefineVariable(identifier string, value interface{}) (err erro
 		}
 		err = newError(C.yr_scanner_define_boolean_variable(
 			s.cptr, cid, C.int(v)))
-	case int, int8, int16, int32, int64, uint, uint8, uint32, uint64:
-		value := toint64(value)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		var i int64
+		if i, err = toint64(value); err != nil {
+			break
+		}
+		err = newError(C.yr_scanner_define_integer_variable(
+			s.cptr, cid, C.int64_t(i)))
+	case time.Time:
 		err = newError(C.yr_scanner_define_integer_variable(
-			s.cptr, cid, C.int64_t(value)))
+			s.cptr, cid, C.int64_t(value.(time.Time).Unix())))
 	case float64:
 		err = newError(C.yr_scanner_define_float_variable(
 			s.cptr, cid, C.double(value.(float64))))
@@ -97,7 +143,13 @@ func (s *Scanner) DefineVariable(identifier string, value interface{}) (err erro
 		err = newError(C.yr_scanner_define_string_variable(
 			s.cptr, cid, cvalue))
 	default:
-		err = errors.New("wrong value type passed to DefineVariable; bool, int64, float64, string are accepted")
+		err = errors.New("wrong value type passed to DefineVariable; bool, int64, float64, string, time.Time are accepted")
+	}
+	if err == nil {
+		if s.variables == nil {
+			s.variables = make(map[string]interface{})
+		}
+		s.variables[identifier] = value
 	}
 	runtime.KeepAlive(s)
 	return
@@ -111,6 +163,7 @@ func (s *Scanner) SetFlags(flags ScanFlags) *Scanner {
 
 // SetTimeout sets a timeout for the scanner.
 func (s *Scanner) SetTimeout(timeout time.Duration) *Scanner {
+	s.timeout = timeout
 	C.yr_scanner_set_timeout(s.cptr, C.int(timeout/time.Second))
 	return s
 }
@@ -119,6 +172,12 @@ func (s *Scanner) SetTimeout(timeout time.Duration) *Scanner {
 // emitted by libyara during subsequent scan, the appropriate method
 // on the ScanCallback object is called.
 //
+// The callback object is kept until SetCallback is called again and
+// is used for all subsequent scans. Since the same object receives
+// the events of every scan, any state it keeps, such as the matches
+// collected by a *MatchRules, accumulates across scans and has to be
+// reset by the caller as needed.
+//
 // For the common case where only a list of matched rules is relevant,
 // setting a callback object is not necessary.
 func (s *Scanner) SetCallback(cb ScanCallback) *Scanner {
@@ -126,42 +185,216 @@ func (s *Scanner) SetCallback(cb ScanCallback) *Scanner {
 	return s
 }
 
+// SetModuleDataProvider sets an object that provides the data for
+// modules that are imported during subsequent scans. If the callback
+// object implements ScanCallbackModuleImport as well and returns data
+// for a module, that data takes precedence. Buffers that are passed
+// to libyara are freed after each scan.
+func (s *Scanner) SetModuleDataProvider(p ModuleDataProvider) *Scanner {
+	s.moduleData = p
+	return s
+}
+
 // putCallbackData stores the scanner's callback object in
-// callbackData, returning a pointer. If no callback object has been
-// set, it is initialized with the pointer to an empty ScanRules
-// object. The object must be removed from callbackData by the calling
-// ScanXxxx function.
-func (s *Scanner) putCallbackData() unsafe.Pointer {
+// callbackData, returning the container and a pointer. If no callback
+// object has been set, it is initialized with the pointer to an empty
+// ScanRules object. The object must be removed from callbackData by
+// the calling ScanXxxx function.
+func (s *Scanner) putCallbackData() (*scanCallbackContainer, unsafe.Pointer) {
 	if _, ok := s.Callback.(ScanCallback); !ok {
 		s.Callback = &MatchRules{}
 	}
-	ptr := callbackData.Put(makeScanCallbackContainer(s.Callback, s.rules))
+	var cb ScanCallback = s.Callback
+	if s.moduleData != nil {
+		cb = MultiCallback{s.Callback, moduleDataProviderCallback{s.moduleData}}
+	}
+	cbc := makeScanCallbackContainer(cb, s.rules)
+	ptr := callbackData.Put(cbc)
 	C.yr_scanner_set_callback(s.cptr, C.YR_CALLBACK_FUNC(C.scanCallbackFunc), ptr)
-	return ptr
+	return cbc, ptr
+}
+
+// scan sets up the scanner's callback object and flags, which are
+// combined with the flags passed for the current scan, calls
+// scanFunc which is expected to call one of libyara's
+// yr_scanner_scan_xxx functions, and records statistics. It returns
+// ErrRulesReleased if the ruleset has been destroyed, and
+// ErrNilCallback if the callback is a nil pointer.
+func (s *Scanner) scan(flags ScanFlags, scanFunc func() C.int) (err error) {
+	if s.rules.cptr == nil {
+		return ErrRulesReleased
+	}
+	if err = checkScanCallback(s.Callback); err != nil {
+		return
+	}
+	cbc, cbPtr := s.putCallbackData()
+	defer cbc.finalize()
+	defer callbackData.Delete(cbPtr)
+
+	C.yr_scanner_set_flags(s.cptr, (s.flags | flags).withReportFlags(s.Callback))
+	if err = startScan(cbc.ScanCallback, &ScanContext{cptr: s.cptr, rules: s.rules, noData: true}); err != nil {
+		return
+	}
+	start := time.Now()
+	err = newError(scanFunc())
+	s.stats = ScanStats{
+		Elapsed:       time.Since(start),
+		MatchingRules: cbc.matching,
+	}
+	runtime.KeepAlive(s)
+	return
 }
 
 // ScanMem scans an in-memory buffer using the scanner.
 //
 // If no callback object has been set for the scanner using
 // SetCAllback, it is initialized with an empty MatchRules object.
+//
+// ErrBufferTooLarge is returned if buf exceeds the size limit of the
+// platform's size_t type.
+//
+// As with (*Rules).ScanMem, ErrScanTimeout is returned if the scan
+// times out, and any matches that have been recorded by the callback
+// object up to that point are left in place.
 func (s *Scanner) ScanMem(buf []byte) (err error) {
+	return s.ScanMemWithFlags(buf, 0)
+}
+
+// ScanMemWithFlags scans an in-memory buffer using the scanner, like
+// ScanMem. The flags are combined (OR-ed) with the flags that have
+// been set using SetFlags, for this scan only.
+func (s *Scanner) ScanMemWithFlags(buf []byte, flags ScanFlags) (err error) {
+	if err = checkBufferSize(buf); err != nil {
+		return
+	}
 	var ptr *C.uint8_t
 	if len(buf) > 0 {
 		ptr = (*C.uint8_t)(unsafe.Pointer(&(buf[0])))
 	}
+	return s.scan(flags, func() C.int {
+		if f := blockScanned(s.Callback); f != nil {
+			f(&ScanContext{cptr: s.cptr, rules: s.rules, noData: true}, 0, len(buf))
+		}
+		return C.yr_scanner_scan_mem(
+			s.cptr,
+			ptr,
+			C.size_t(len(buf)))
+	})
+}
 
-	cbPtr := s.putCallbackData()
-	defer callbackData.Delete(cbPtr)
+// ScanMemAsync starts scanning an in-memory buffer using the scanner
+// in a new goroutine, like ScanMemWithFlags, and returns immediately.
+// The scan's result is sent to done, which is closed afterwards. cb
+// and timeout are only used for this scan; the scanner's callback
+// object and timeout are restored before the result is sent. s must
+// not be used until the scan has finished.
+//
+// Calling cancel asks libyara to abort the scan, in which case
+// ErrScanCanceled is sent to done. Since libyara can only be aborted
+// while it delivers a callback message, e.g. when a module is
+// imported or when a rule is reported, the scan may still run to
+// completion; the timeout bounds the time spent on a scan. cancel
+// may be called more than once, also after the scan has finished.
+func (s *Scanner) ScanMemAsync(buf []byte, flags ScanFlags, timeout time.Duration, cb ScanCallback) (cancel func(), done <-chan error) {
+	sc := &scanCanceler{}
+	ch := make(chan error, 1)
+	wrapped := MultiCallback{sc}
+	if cb != nil {
+		wrapped = append(wrapped, cb)
+	}
+	prevCallback, prevTimeout := s.Callback, s.timeout
+	s.SetCallback(wrapped).SetTimeout(timeout)
+	go func() {
+		err := s.ScanMemWithFlags(buf, flags)
+		s.SetCallback(prevCallback).SetTimeout(prevTimeout)
+		if err == nil && atomic.LoadInt32(&sc.aborted) != 0 {
+			err = ErrScanCanceled
+		}
+		ch <- err
+		close(ch)
+	}()
+	return func() { atomic.StoreInt32(&sc.canceled, 1) }, ch
+}
 
-	C.yr_scanner_set_flags(s.cptr, s.flags.withReportFlags(s.Callback))
-	err = newError(C.yr_scanner_scan_mem(
-		s.cptr,
-		ptr,
-		C.size_t(len(buf))))
-	runtime.KeepAlive(s)
-	return
+// ScanMemStreamContext starts scanning an in-memory buffer using the
+// scanner, like ScanMemAsync, and sends every matching rule to the
+// returned matches channel as soon as libyara reports it. The timeout
+// that has been set using SetTimeout is used.
+//
+// The caller must receive from matches until it is closed or cancel
+// ctx. Canceling ctx aborts the scan; both channels are closed once
+// the scan has finished, after the result has been sent to errs. If
+// the scan has been aborted, ctx.Err() is sent. The scanner's
+// callback object is not used and s must not be used until the scan
+// has finished.
+func (s *Scanner) ScanMemStreamContext(ctx context.Context, buf []byte, flags ScanFlags) (<-chan MatchRule, <-chan error) {
+	matches := make(chan MatchRule)
+	errs := make(chan error, 1)
+	ms := &matchStreamer{ctx: ctx, matches: matches}
+	cancel, done := s.ScanMemAsync(buf, flags, s.timeout, ms)
+	go func() {
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			cancel()
+			err = <-done
+		}
+		if err == ErrScanCanceled || (err == nil && ms.aborted) {
+			err = ctx.Err()
+		}
+		close(matches)
+		errs <- err
+		close(errs)
+	}()
+	return matches, errs
+}
+
+// matchStreamer is used by ScanMemStreamContext to send matching
+// rules to a channel.
+type matchStreamer struct {
+	ctx     context.Context
+	matches chan<- MatchRule
+	aborted bool
+}
+
+func (ms *matchStreamer) RuleMatching(sc *ScanContext, r *Rule) (bool, error) {
+	var m MatchRules
+	if _, err := m.Collector().RuleMatching(sc, r); err != nil || len(m) == 0 {
+		return false, err
+	}
+	select {
+	case ms.matches <- m[0]:
+		return false, nil
+	case <-ms.ctx.Done():
+		ms.aborted = true
+		return true, nil
+	}
 }
 
+// scanCanceler is used by ScanMemAsync to abort a scan at the next
+// callback message once it has been canceled.
+type scanCanceler struct{ canceled, aborted int32 }
+
+func (sc *scanCanceler) abort() (bool, error) {
+	if atomic.LoadInt32(&sc.canceled) == 0 {
+		return false, nil
+	}
+	atomic.StoreInt32(&sc.aborted, 1)
+	return true, nil
+}
+
+func (sc *scanCanceler) RuleMatching(*ScanContext, *Rule) (bool, error) { return sc.abort() }
+
+func (sc *scanCanceler) RuleNotMatching(*ScanContext, *Rule) (bool, error) { return sc.abort() }
+
+func (sc *scanCanceler) ImportModule(*ScanContext, string) ([]byte, bool, error) {
+	abort, err := sc.abort()
+	return nil, abort, err
+}
+
+func (sc *scanCanceler) ModuleImported(*ScanContext, *Object) (bool, error) { return sc.abort() }
+
 // ScanFile scans a file using the scanner.
 //
 // If no callback object has been set for the scanner using
@@ -169,17 +402,12 @@ func (s *Scanner) ScanMem(buf []byte) (err error) {
 func (s *Scanner) ScanFile(filename string) (err error) {
 	cfilename := C.CString(filename)
 	defer C.free(unsafe.Pointer(cfilename))
-
-	cbPtr := s.putCallbackData()
-	defer callbackData.Delete(cbPtr)
-
-	C.yr_scanner_set_flags(s.cptr, s.flags.withReportFlags(s.Callback))
-	err = newError(C.yr_scanner_scan_file(
-		s.cptr,
-		cfilename,
-	))
-	runtime.KeepAlive(s)
-	return
+	return s.scan(0, func() C.int {
+		return C.yr_scanner_scan_file(
+			s.cptr,
+			cfilename,
+		)
+	})
 }
 
 // ScanFileDescriptor scans a file using the scanner.
@@ -187,15 +415,23 @@ func (s *Scanner) ScanFile(filename string) (err error) {
 // If no callback object has been set for the scanner using
 // SetCAllback, it is initialized with an empty MatchRules object.
 func (s *Scanner) ScanFileDescriptor(fd uintptr) (err error) {
-	cbPtr := s.putCallbackData()
-	defer callbackData.Delete(cbPtr)
+	return s.scan(0, func() C.int {
+		return C._yr_scanner_scan_fd(
+			s.cptr,
+			C.int(fd),
+		)
+	})
+}
 
-	C.yr_scanner_set_flags(s.cptr, s.flags.withReportFlags(s.Callback))
-	err = newError(C._yr_scanner_scan_fd(
-		s.cptr,
-		C.int(fd),
-	))
-	runtime.KeepAlive(s)
+// ScanOSFile scans an opened file using the scanner. The file's
+// descriptor (or handle, on Windows) is passed to libyara; the file is
+// not closed.
+//
+// If no callback object has been set for the scanner using
+// SetCAllback, it is initialized with an empty MatchRules object.
+func (s *Scanner) ScanOSFile(f *os.File) (err error) {
+	err = s.ScanFileDescriptor(f.Fd())
+	runtime.KeepAlive(f)
 	return
 }
 
@@ -204,16 +440,12 @@ func (s *Scanner) ScanFileDescriptor(fd uintptr) (err error) {
 // If no callback object has been set for the scanner using
 // SetCAllback, it is initialized with an empty MatchRules object.
 func (s *Scanner) ScanProc(pid int) (err error) {
-	cbPtr := s.putCallbackData()
-	defer callbackData.Delete(cbPtr)
-
-	C.yr_scanner_set_flags(s.cptr, s.flags.withReportFlags(s.Callback))
-	err = newError(C.yr_scanner_scan_proc(
-		s.cptr,
-		C.int(pid),
-	))
-	runtime.KeepAlive(s)
-	return
+	return s.scan(0, func() C.int {
+		return C.yr_scanner_scan_proc(
+			s.cptr,
+			C.int(pid),
+		)
+	})
 }
 
 // ScahMemBlocks scans over a MemoryBlockIterator using the scanner.
@@ -223,19 +455,32 @@ func (s *Scanner) ScanProc(pid int) (err error) {
 func (s *Scanner) ScanMemBlocks(mbi MemoryBlockIterator) (err error) {
 	c := makeMemoryBlockIteratorContainer(mbi)
 	defer c.free()
+	c.setBlockCallback(s.Callback, &ScanContext{cptr: s.cptr, rules: s.rules, noData: true})
 	cmbi := makeCMemoryBlockIterator(c)
 	defer callbackData.Delete(cmbi.context)
+	return s.scan(0, func() C.int {
+		return C.yr_scanner_scan_mem_blocks(
+			s.cptr,
+			cmbi,
+		)
+	})
+}
 
-	cbPtr := s.putCallbackData()
-	defer callbackData.Delete(cbPtr)
+// ScanStats contains statistics about a scan.
+type ScanStats struct {
+	// Elapsed is the wall-clock time spent in libyara's scan
+	// function, including the time spent in callback methods.
+	// (libyara does not expose its internal timing.)
+	Elapsed time.Duration
+	// MatchingRules is the number of rules that have been reported
+	// as matching.
+	MatchingRules int
+}
 
-	C.yr_scanner_set_flags(s.cptr, s.flags.withReportFlags(s.Callback))
-	err = newError(C.yr_scanner_scan_mem_blocks(
-		s.cptr,
-		cmbi,
-	))
-	runtime.KeepAlive(s)
-	return
+// LastScanStats returns statistics about the scanner's most recent
+// scan.
+func (s *Scanner) LastScanStats() ScanStats {
+	return s.stats
 }
 
 // GetLastErrorRule returns the Rule which caused the last error.
@@ -256,7 +501,7 @@ func (s *Scanner) GetLastErrorRule() (r *Rule) {
 func (s *Scanner) GetLastErrorString() (r *String) {
 	ptr := C.yr_scanner_last_error_string(s.cptr)
 	if ptr != nil {
-		r = &String{ptr, s.rules}
+		r = &String{cptr: ptr, rules: s.rules}
 	}
 	runtime.KeepAlive(s)
 	return
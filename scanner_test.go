@@ -8,10 +8,13 @@ package yara
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"runtime"
 	"testing"
+	"time"
 )
 
 func makeScanner(t *testing.T, rule string) *Scanner {
@@ -212,3 +215,503 @@ func TestScannerLastError(t *testing.T) {
 		t.Errorf("GetLastErrorString: returned wrong string %q", str.Identifier())
 	}
 }
+
+func TestScannerTimeVariable(t *testing.T) {
+	c, err := NewCompiler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DefineVariable("timestamp", time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddString(`rule t { condition: timestamp > 1577836800 }`, ""); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewScanner(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ts      time.Time
+		matches int
+	}{
+		{time.Date(2019, 12, 31, 0, 0, 0, 0, time.UTC), 0},
+		{time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), 1},
+	} {
+		if err := s.DefineVariable("timestamp", tc.ts); err != nil {
+			t.Fatal(err)
+		}
+		var m MatchRules
+		if err := s.SetCallback(&m).ScanMem(nil); err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != tc.matches {
+			t.Errorf("timestamp=%v: expected %d matches, got %d", tc.ts, tc.matches, len(m))
+		}
+	}
+}
+
+func TestScannerSignedVariables(t *testing.T) {
+	c, err := NewCompiler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DefineVariable("timestamp", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddString(`rule t { condition: timestamp < -1 }`, ""); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewScanner(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		value   interface{}
+		matches int
+	}{
+		{int(-2), 1},
+		{int8(-2), 1},
+		{int16(-2), 1},
+		{int32(-2), 1},
+		{int64(-1), 0},
+		{int64(-1 << 40), 1},
+		{uint16(2), 0},
+		{uint64(1 << 40), 0},
+	} {
+		if err := s.DefineVariable("timestamp", tc.value); err != nil {
+			t.Errorf("DefineVariable(%T(%v)): %v", tc.value, tc.value, err)
+			continue
+		}
+		var m MatchRules
+		if err := s.SetCallback(&m).ScanMem(nil); err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != tc.matches {
+			t.Errorf("timestamp=%T(%v): expected %d matches, got %d", tc.value, tc.value, tc.matches, len(m))
+		}
+	}
+	if err := s.DefineVariable("timestamp", uint64(1<<63)); err == nil {
+		t.Error("DefineVariable accepted uint64 value that does not fit into int64")
+	}
+}
+
+func TestScannerLastScanStats(t *testing.T) {
+	s := makeScanner(t, `rule a { condition: true } rule b { condition: false } rule c { condition: true }`)
+	if st := s.LastScanStats(); st != (ScanStats{}) {
+		t.Errorf("expected empty stats before scan, got %+v", st)
+	}
+	var m MatchRules
+	if err := s.SetCallback(&m).ScanMem([]byte("dummy")); err != nil {
+		t.Fatal(err)
+	}
+	st := s.LastScanStats()
+	if st.MatchingRules != 2 {
+		t.Errorf("expected 2 matching rules, got %d", st.MatchingRules)
+	}
+	if st.Elapsed <= 0 {
+		t.Errorf("expected positive elapsed time, got %v", st.Elapsed)
+	}
+	t.Logf("stats: %+v", st)
+}
+
+type importOrderCallback []string
+
+func (c *importOrderCallback) RuleMatching(*ScanContext, *Rule) (bool, error) {
+	return false, nil
+}
+
+func (c *importOrderCallback) ImportModule(_ *ScanContext, name string) ([]byte, bool, error) {
+	*c = append(*c, name)
+	return nil, false, nil
+}
+
+func TestScannerImportOrder(t *testing.T) {
+	s := makeScanner(t, `
+		import "pe"
+		import "tests"
+		import "math"
+		import "pe"
+		rule t { condition: true }`)
+	expected := importOrderCallback{"pe", "tests", "math"}
+	for i := 0; i < 3; i++ {
+		var cb importOrderCallback
+		if err := s.SetCallback(&cb).ScanMem([]byte("")); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cb, expected) {
+			t.Errorf("scan %d: expected imports %v, got %v", i, expected, cb)
+		}
+	}
+}
+
+func TestScannerClone(t *testing.T) {
+	c, err := NewCompiler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DefineVariable("name", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddString(`rule t { condition: name == "worker" }`, ""); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewScanner(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DefineVariable("name", "worker"); err != nil {
+		t.Fatal(err)
+	}
+	s.SetFlags(ScanFlagsFastMode).SetTimeout(time.Minute)
+	clone, err := s.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone.flags != s.flags || clone.timeout != s.timeout {
+		t.Errorf("flags/timeout were not copied")
+	}
+	var m MatchRules
+	if err := clone.SetCallback(&m).ScanMem([]byte("dummy")); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Errorf("expected 1 match using cloned variables, got %d", len(m))
+	}
+}
+
+func TestScannerRulesReleased(t *testing.T) {
+	s := makeScanner(t, `rule t { condition: true }`)
+	// makeScanner does not keep a reference to the Rules object, so
+	// only the Scanner keeps it from being finalized.
+	runtime.GC()
+	runtime.GC()
+	var m MatchRules
+	if err := s.SetCallback(&m).ScanMem([]byte("dummy")); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Errorf("expected 1 match, got %d", len(m))
+	}
+	s.rules.Destroy()
+	if err := s.ScanMem([]byte("dummy")); err != ErrRulesReleased {
+		t.Errorf("expected ErrRulesReleased, got %v", err)
+	}
+	if err := s.rules.ScanMem([]byte("dummy"), 0, 0, &m); err != ErrRulesReleased {
+		t.Errorf("expected ErrRulesReleased from Rules.ScanMem, got %v", err)
+	}
+}
+
+type flagsCallback ScanFlags
+
+func (c *flagsCallback) RuleMatching(sc *ScanContext, _ *Rule) (bool, error) {
+	*c = flagsCallback(sc.Flags())
+	return false, nil
+}
+
+func TestScannerScanMemWithFlags(t *testing.T) {
+	s := makeScanner(t, `rule t { condition: true }`)
+	var cb flagsCallback
+	s.SetFlags(ScanFlagsFastMode).SetCallback(&cb)
+	if err := s.ScanMemWithFlags([]byte("dummy"), ScanFlagsProcessMemory); err != nil {
+		t.Fatal(err)
+	}
+	if ScanFlags(cb)&ScanFlagsFastMode == 0 || ScanFlags(cb)&ScanFlagsProcessMemory == 0 {
+		t.Errorf("expected scanner and per-call flags to be combined, got %#x", cb)
+	}
+	if err := s.ScanMem([]byte("dummy")); err != nil {
+		t.Fatal(err)
+	}
+	if ScanFlags(cb)&ScanFlagsProcessMemory != 0 {
+		t.Errorf("per-call flags were retained by scanner: %#x", cb)
+	}
+}
+
+func TestScannerTimeout(t *testing.T) {
+	s := makeScanner(t, timeoutRules)
+	cb := &timeoutRecorder{}
+	err := s.SetTimeout(1 * time.Second).SetCallback(cb).ScanMem(make([]byte, 20000))
+	checkTimeoutRecorder(t, err, cb)
+	if s.Callback != cb {
+		t.Error("callback object was replaced")
+	}
+}
+
+type testLogCallback struct{ log []string }
+
+func (cb *testLogCallback) RuleMatching(_ *ScanContext, r *Rule) (bool, error) {
+	cb.log = append(cb.log, "match "+r.Identifier())
+	return false, nil
+}
+
+func (cb *testLogCallback) ScanFinished(*ScanContext) (bool, error) {
+	cb.log = append(cb.log, "finished")
+	return false, nil
+}
+
+func TestScannerPersistentCallback(t *testing.T) {
+	s := makeScanner(t, `rule t { strings: $a = "abc" condition: $a }`)
+	cb := &testLogCallback{}
+	s.SetCallback(cb)
+	for _, buf := range []string{" abc ", " def ", " abc "} {
+		if err := s.ScanMem([]byte(buf)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{"match t", "finished", "finished", "match t", "finished"}
+	if !reflect.DeepEqual(cb.log, expected) {
+		t.Errorf("expected %v, got %v", expected, cb.log)
+	}
+}
+
+type testCancelCallback struct {
+	ready  chan struct{}
+	cancel func()
+	rules  []string
+}
+
+func (cb *testCancelCallback) RuleMatching(_ *ScanContext, r *Rule) (bool, error) {
+	<-cb.ready
+	cb.rules = append(cb.rules, r.Identifier())
+	cb.cancel()
+	return false, nil
+}
+
+func TestScannerScanMemAsync(t *testing.T) {
+	s := makeScanner(t, `
+rule a { condition: true }
+rule b { condition: true }
+rule c { condition: true }`)
+	var prev MatchRules
+	s.SetCallback(&prev).SetTimeout(30 * time.Second)
+	var m MatchRules
+	_, done := s.ScanMemAsync([]byte(""), 0, 10*time.Second, &m)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-done; ok {
+		t.Error("done has not been closed")
+	}
+	if len(m) != 3 {
+		t.Errorf("unexpected matches: %+v", m)
+	}
+	if s.Callback != &prev || s.timeout != 30*time.Second {
+		t.Errorf("callback or timeout not restored: %#v, %v", s.Callback, s.timeout)
+	}
+	if len(prev) != 0 {
+		t.Errorf("previous callback was used: %+v", prev)
+	}
+
+	cb := &testCancelCallback{ready: make(chan struct{})}
+	cancel, done := s.ScanMemAsync([]byte(""), 0, 0, cb)
+	cb.cancel = cancel
+	close(cb.ready)
+	if err := <-done; err != ErrScanCanceled {
+		t.Errorf("expected ErrScanCanceled, got %v", err)
+	}
+	if len(cb.rules) == 3 {
+		t.Errorf("scan has not been aborted: %v", cb.rules)
+	}
+	if s.Callback != &prev {
+		t.Errorf("callback not restored after cancel: %#v", s.Callback)
+	}
+	cancel()
+}
+
+func BenchmarkSmallBuffers(b *testing.B) {
+	r, err := Compile(`rule t { strings: $a = "abc" $b = { 4D 5A ?? 00 } condition: any of them }`, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := bytes.Repeat([]byte("0123456789"), 10)
+	b.Run("Rules", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := r.CountMatches(buf, 0, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Scanner", func(b *testing.B) {
+		s, err := NewScanner(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer s.Destroy()
+		var m MatchRules
+		s.SetCallback(&m)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m = m[:0]
+			if err := s.ScanMem(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+type testModuleDataProvider struct{ calls int }
+
+func (p *testModuleDataProvider) Data(module string) ([]byte, error) {
+	p.calls++
+	if module == "tests" {
+		return []byte("injected"), nil
+	}
+	return nil, nil
+}
+
+func TestScannerModuleDataProvider(t *testing.T) {
+	s := makeScanner(t, `
+		import "tests"
+		rule t { condition: tests.module_data == "injected" }`)
+	p := &testModuleDataProvider{}
+	s.SetModuleDataProvider(p)
+	for i := 0; i < 3; i++ {
+		var m MatchRules
+		if err := s.SetCallback(&m).ScanMem([]byte("dummy")); err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != 1 {
+			t.Errorf("scan %d: expected 1 match, got %d", i, len(m))
+		}
+	}
+	if p.calls != 3 {
+		t.Errorf("expected provider to be called 3 times, got %d", p.calls)
+	}
+}
+
+func TestScannerScanMemStreamContext(t *testing.T) {
+	s := makeScanner(t, `
+rule a { condition: true }
+rule b { condition: true }
+rule c { condition: true }`)
+	matches, errs := s.ScanMemStreamContext(context.Background(), []byte(""), 0)
+	var names []string
+	for m := range matches {
+		names = append(names, m.Rule)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	matches, errs = s.ScanMemStreamContext(ctx, []byte(""), 0)
+	if m := <-matches; m.Rule != "a" {
+		t.Errorf("unexpected first match %+v", m)
+	}
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if m, ok := <-matches; ok {
+		t.Errorf("unexpected match after cancellation: %+v", m)
+	}
+}
+
+func TestMatchCollectorDataHash(t *testing.T) {
+	s := makeScanner(t, `rule t { condition: true }`)
+	var m MatchRules
+	s.SetCallback(m.Collector().SetDataHash(true))
+	for _, buf := range []string{"abc", ""} {
+		if err := s.ScanMem([]byte(buf)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{
+		"ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}
+	if len(m) != 2 {
+		t.Fatalf("unexpected matches: %+v", m)
+	}
+	for i := range m {
+		if m[i].DataHash != expected[i] {
+			t.Errorf("scan %d: expected hash %s, got %s", i, expected[i], m[i].DataHash)
+		}
+	}
+	// An aborted scan is not followed by ScanFinished; the next scan
+	// must still compute a fresh hash.
+	m = nil
+	s.SetCallback(MultiCallback{m.Collector().SetDataHash(true), &abortingCallback{}})
+	for _, buf := range []string{"abc", ""} {
+		if err := s.ScanMem([]byte(buf)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m) != 2 {
+		t.Fatalf("unexpected matches: %+v", m)
+	}
+	for i := range m {
+		if m[i].DataHash != expected[i] {
+			t.Errorf("aborted scan %d: expected hash %s, got %s", i, expected[i], m[i].DataHash)
+		}
+	}
+}
+
+type variableCallback struct{ values map[string]interface{} }
+
+func (c *variableCallback) RuleMatching(sc *ScanContext, r *Rule) (bool, error) {
+	for _, name := range []string{"filename", "size", "ratio", "flag", "missing"} {
+		if v, ok := sc.GetVariable(name); ok {
+			c.values[name] = v
+		}
+	}
+	return false, nil
+}
+
+func TestScanContextGetVariable(t *testing.T) {
+	c, err := NewCompiler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	c.DefineVariable("filename", "")
+	c.DefineVariable("size", 0)
+	c.DefineVariable("ratio", 0.0)
+	c.DefineVariable("flag", false)
+	if err := c.AddString(`rule t { condition: filename endswith ".exe" }`, ""); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewScanner(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy()
+	s.DefineVariable("filename", "sample.exe")
+	s.DefineVariable("size", 42)
+	s.DefineVariable("ratio", 0.5)
+	s.DefineVariable("flag", true)
+	cb := &variableCallback{values: make(map[string]interface{})}
+	if err := s.SetCallback(cb).ScanMem([]byte("")); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"filename": "sample.exe",
+		"size":     int64(42),
+		"ratio":    0.5,
+		"flag":     int64(1),
+	}
+	if !reflect.DeepEqual(cb.values, expected) {
+		t.Errorf("expected %v, got %v", expected, cb.values)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright © 2015-2020 Hilko Bengen <bengen@hilluzination.de>
+// All rights reserved.
+//
+// Use of this source code is governed by the license that can be
+// found in the LICENSE file.
+
+// Package sniff contains heuristics for classifying data before it is
+// scanned, e.g. to select a ruleset. It does not depend on libyara.
+package sniff
+
+// LooksBinary reports whether buf appears to contain binary rather
+// than text data. It checks at most the first 8 KiB of buf: data
+// containing NUL bytes, or where more than 10% of the bytes are
+// control characters other than tab, newline, carriage return, and
+// form feed, is considered binary. Bytes >= 0x80 are not counted, so
+// UTF-8 text is not considered binary. An empty buffer is considered
+// text.
+func LooksBinary(buf []byte) bool {
+	if len(buf) > 8192 {
+		buf = buf[:8192]
+	}
+	var n int
+	for _, b := range buf {
+		switch {
+		case b == 0:
+			return true
+		case b == '\t' || b == '\n' || b == '\r' || b == '\f':
+		case b < 0x20 || b == 0x7f:
+			n++
+		}
+	}
+	return n*10 > len(buf)
+}
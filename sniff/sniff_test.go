@@ -0,0 +1,34 @@
+// Copyright © 2015-2020 Hilko Bengen <bengen@hilluzination.de>
+// All rights reserved.
+//
+// Use of this source code is governed by the license that can be
+// found in the LICENSE file.
+
+package sniff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLooksBinary(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		buf    []byte
+		binary bool
+	}{
+		{"empty", nil, false},
+		{"ascii", []byte("rule t { condition: true }\r\n\tfoo\f\n"), false},
+		{"utf-8", []byte("Grüße, 世界\n"), false},
+		{"nul", []byte("MZ\x90\x00\x03"), true},
+		{"control", []byte("\x01\x02\x03\x04abcdef"), true},
+		{"few control", []byte("\x01abcdefghijklmnopqrstuvwxyz"), false},
+		{"backspace", []byte("ab\b\b\bcd"), true},
+		{"escape", []byte("\x1b[1m\x1b[0m\x1b[31m"), true},
+		{"nul after 8 KiB", []byte(strings.Repeat("a", 8192) + "\x00"), false},
+	} {
+		if got := LooksBinary(c.buf); got != c.binary {
+			t.Errorf("%s: expected %v, got %v", c.name, c.binary, got)
+		}
+	}
+}
@@ -134,3 +134,50 @@ func TestScannerFileWalk(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestCompilerParallel(t *testing.T) {
+	const goroutines, iterations = 16, 32
+	errs := make(chan error, goroutines)
+	wg := sync.WaitGroup{}
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				c, err := NewCompiler()
+				if err != nil {
+					errs <- err
+					return
+				}
+				c.SetIncludeCallback(func(name, _, _ string) []byte {
+					return []byte(fmt.Sprintf(`rule %s { condition: true }`, name))
+				})
+				if err := c.AddString(fmt.Sprintf(`include "inc_%d_%d"
+rule r_%d_%d { strings: $a = "%d-%d" condition: $a }`, i, j, i, j, i, j), ""); err != nil {
+					errs <- err
+					return
+				}
+				r, err := c.GetRules()
+				c.Destroy()
+				if err != nil {
+					errs <- err
+					return
+				}
+				var m MatchRules
+				if err := r.ScanMem([]byte(fmt.Sprintf("%d-%d", i, j)), 0, 0, &m); err != nil {
+					errs <- err
+					return
+				}
+				if len(m) != 2 {
+					errs <- fmt.Errorf("goroutine %d, iteration %d: expected 2 matches, got %d", i, j, len(m))
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
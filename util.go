@@ -6,30 +6,84 @@
 
 package yara
 
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
 var callbackData = makecbPool(256)
 
-func toint64(number interface{}) int64 {
+var logger struct {
+	f func(string)
+	m sync.RWMutex
+}
+
+// SetLogger sets a function that receives diagnostic messages from
+// the binding's glue code, e.g. when a callback from libyara cannot be
+// dispatched or when a callback method returns an error. Logging is
+// disabled by default; passing nil disables it again.
+func SetLogger(f func(string)) {
+	logger.m.Lock()
+	logger.f = f
+	logger.m.Unlock()
+}
+
+// logf formats a diagnostic message and passes it to the function
+// that has been set using SetLogger.
+func logf(format string, args ...interface{}) {
+	logger.m.RLock()
+	f := logger.f
+	logger.m.RUnlock()
+	if f != nil {
+		f(fmt.Sprintf(format, args...))
+	}
+}
+
+var errIntegerRange = errors.New("integer value does not fit into int64")
+
+// toint64 converts number to int64. An error is returned for unsigned
+// values that would change their sign.
+func toint64(number interface{}) (int64, error) {
 	switch number.(type) {
 	case int:
-		return int64(number.(int))
+		return int64(number.(int)), nil
 	case int8:
-		return int64(number.(int8))
+		return int64(number.(int8)), nil
 	case int16:
-		return int64(number.(int16))
+		return int64(number.(int16)), nil
 	case int32:
-		return int64(number.(int32))
+		return int64(number.(int32)), nil
 	case int64:
-		return int64(number.(int64))
+		return int64(number.(int64)), nil
 	case uint:
-		return int64(number.(uint))
+		if uint64(number.(uint)) > math.MaxInt64 {
+			return 0, errIntegerRange
+		}
+		return int64(number.(uint)), nil
 	case uint8:
-		return int64(number.(uint8))
+		return int64(number.(uint8)), nil
 	case uint16:
-		return int64(number.(uint16))
+		return int64(number.(uint16)), nil
 	case uint32:
-		return int64(number.(uint32))
+		return int64(number.(uint32)), nil
 	case uint64:
-		return int64(number.(uint64))
+		if number.(uint64) > math.MaxInt64 {
+			return 0, errIntegerRange
+		}
+		return int64(number.(uint64)), nil
 	}
 	panic("wrong number")
 }
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}